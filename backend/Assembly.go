@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+type Assembly struct {
+	Name string `json:"Name" db:"Name"`
+}
+
+var assemblyList = ListSpec{
+	Fields: map[string]ListField{"name": {"Name", fieldString}},
+	Order:  "Name",
+}
+
+type Chromosome struct {
+	Assembly string `json:"Assembly" db:"Assembly"`
+	Name     string `json:"Name" db:"Name"`
+	Length   int    `json:"Length" db:"Length"`
+}
+
+var chromosomeList = ListSpec{
+	Fields: map[string]ListField{
+		"name":   {"Name", fieldString},
+		"length": {"Length", fieldInt},
+	},
+	Order: "Name",
+}
+
+type ChromosomeAlias struct {
+	Assembly   string `json:"Assembly" db:"Assembly"`
+	Alias      string `json:"Alias" db:"Alias"`
+	Chromosome string `json:"Chromosome" db:"Chromosome"`
+}
+
+/**
+Active assembly
+Chromosome names and sizes of the assembly in use are kept in memory, since
+every Create and Save of an interval needs them. When no assembly is loaded
+chromosome names are only normalized to the "chrN" form, and not bounds checked.
+**/
+
+type chromosomeRegistry struct {
+	sync.RWMutex
+	assembly string
+	lengths  map[string]int
+	aliases  map[string]string
+}
+
+var activeAssembly = &chromosomeRegistry{}
+
+// Resolves any known alias of a chromosome to its name in the active assembly.
+func (c *chromosomeRegistry) resolve(chr string) (name string, known bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.assembly == "" {
+		return "", false
+	}
+	if name, ok := c.aliases[chr]; ok {
+		return name, true
+	}
+	if name, ok := c.aliases[strings.ToLower(chr)]; ok {
+		return name, true
+	}
+	return "", false
+}
+
+// Checks a normalized region lies within its chromosome of the active assembly.
+func (c *chromosomeRegistry) check(r Region) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.assembly == "" {
+		return nil
+	}
+	length, ok := c.lengths[r.Chr]
+	if !ok {
+		return RegionError{r.String(), fmt.Sprintf("chromosome %s is not part of %s", r.Chr, c.assembly)}
+	}
+	if r.End > length {
+		return RegionError{r.String(), fmt.Sprintf("end is past the end of %s (%d)", r.Chr, length)}
+	}
+	return nil
+}
+
+// Replaces the in memory registry with the chromosomes of an assembly.
+func UseAssembly(name string) error {
+	chromosomes, err := Assembly{name}.GetChromosomes()
+	if err != nil {
+		return err
+	}
+	if len(chromosomes) == 0 {
+		return fmt.Errorf("assembly %s has no chromosomes loaded", name)
+	}
+	aliases, err := Assembly{name}.GetAliases()
+	if err != nil {
+		return err
+	}
+
+	lengths := make(map[string]int)
+	aliasMap := make(map[string]string)
+	for _, c := range chromosomes {
+		lengths[c.Name] = c.Length
+		aliasMap[c.Name] = c.Name
+		aliasMap[strings.ToLower(c.Name)] = c.Name
+	}
+	for _, a := range aliases {
+		aliasMap[a.Alias] = a.Chromosome
+		aliasMap[strings.ToLower(a.Alias)] = a.Chromosome
+	}
+
+	activeAssembly.Lock()
+	defer activeAssembly.Unlock()
+	activeAssembly.assembly = name
+	activeAssembly.lengths = lengths
+	activeAssembly.aliases = aliasMap
+	return nil
+}
+
+/*
+Picks the assembly to normalize against. GENOME_ASSEMBLY takes priority,
+otherwise the only assembly in the database is used if there is exactly one.
+*/
+func loadActiveAssembly() error {
+	name, set := os.LookupEnv("GENOME_ASSEMBLY")
+	if !set {
+		assemblies, err := GetAssemblies()
+		if err != nil {
+			return err
+		}
+		if len(assemblies) != 1 {
+			return nil
+		}
+		name = assemblies[0].Name
+	}
+	return UseAssembly(name)
+}
+
+/** SQL Helpers **/
+
+func GetAssemblies() ([]Assembly, error) {
+	query := `SELECT * FROM Assemblies`
+	rows, err := db.Queryx(query)
+	if err != nil {
+		return []Assembly{}, err
+	}
+	defer rows.Close()
+
+	result := make([]Assembly, 0)
+	for rows.Next() {
+		var a Assembly
+		err = rows.StructScan(&a)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+func GetAssembly(name string) (Assembly, error) {
+	query := `SELECT * FROM Assemblies WHERE Name=?`
+	rows, err := db.Queryx(query, name)
+	if err != nil {
+		return Assembly{}, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var a Assembly
+		err = rows.StructScan(&a)
+		return a, err
+	}
+
+	return Assembly{}, notFound("Assembly")
+}
+
+func (a Assembly) GetChromosomes() ([]Chromosome, error) {
+	query := `SELECT * FROM Chromosomes WHERE Assembly=? ORDER BY Name`
+	rows, err := db.Queryx(query, a.Name)
+	if err != nil {
+		return []Chromosome{}, err
+	}
+	defer rows.Close()
+
+	result := make([]Chromosome, 0)
+	for rows.Next() {
+		var c Chromosome
+		err = rows.StructScan(&c)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+func (a Assembly) GetAliases() ([]ChromosomeAlias, error) {
+	query := `SELECT * FROM ChromosomeAliases WHERE Assembly=?`
+	rows, err := db.Queryx(query, a.Name)
+	if err != nil {
+		return []ChromosomeAlias{}, err
+	}
+	defer rows.Close()
+
+	result := make([]ChromosomeAlias, 0)
+	for rows.Next() {
+		var c ChromosomeAlias
+		err = rows.StructScan(&c)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+/*
+Loads a UCSC chrom.sizes file (name and length, tab separated) into an
+assembly, creating the assembly if needed. The prefixless form of every
+"chrN" name (other than scaffolds) is added as an alias, so "X" resolves to "chrX".
+*/
+func LoadChromSizes(assembly string, Filename string) error {
+	f, err := os.Open(Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	csvReader.Comma = '\t'
+	csvReader.FieldsPerRecord = -1
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO Assemblies VALUES (?)`, assembly)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 2 || strings.HasPrefix(rec[0], "#") {
+			continue
+		}
+
+		length, err := strconv.ParseInt(rec[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid length of %s: %s", rec[0], rec[1])
+		}
+
+		_, err = tx.Exec(`INSERT OR REPLACE INTO Chromosomes VALUES (?, ?, ?)`, assembly, rec[0], length)
+		if err != nil {
+			return err
+		}
+
+		if len(rec[0]) > 3 && strings.HasPrefix(rec[0], "chr") && !strings.Contains(rec[0], "_") {
+			short := rec[0][3:]
+			_, err = tx.Exec(`INSERT OR REPLACE INTO ChromosomeAliases VALUES (?, ?, ?)`, assembly, short, rec[0])
+			if err != nil {
+				return err
+			}
+			if short == "M" {
+				_, err = tx.Exec(`INSERT OR REPLACE INTO ChromosomeAliases VALUES (?, ?, ?)`, assembly, "MT", rec[0])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+Loads a UCSC chromAlias file into an assembly whose chromosomes are loaded.
+Each line lists names of the same chromosome (e.g. "chrX  X  NC_000086.7");
+every name other than the one in chrom.sizes becomes an alias of it.
+The older three column format (alias, chromosome, source) is also accepted.
+*/
+func LoadChromAliases(assembly string, Filename string) error {
+	chromosomes, err := Assembly{assembly}.GetChromosomes()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, c := range chromosomes {
+		known[c.Name] = true
+	}
+
+	f, err := os.Open(Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	csvReader.Comma = '\t'
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	header := false
+	for {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) > 0 && strings.HasPrefix(rec[0], "#") {
+			header = true
+			continue
+		}
+
+		names := rec
+		if !header && len(rec) == 3 && known[rec[1]] {
+			names = rec[:2]
+		}
+
+		chromosome := ""
+		for _, n := range names {
+			if known[n] {
+				chromosome = n
+				break
+			}
+		}
+		if chromosome == "" {
+			continue
+		}
+
+		for _, n := range names {
+			if n == "" || n == chromosome {
+				continue
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO ChromosomeAliases VALUES (?, ?, ?)`, assembly, n, chromosome)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func RunAssemblyLoader() {
+	assembly, set := os.LookupEnv("ASSEMBLY_NAME")
+	if !set {
+		assembly = os.Getenv("GENOME_ASSEMBLY")
+	}
+	sizesPath := os.Getenv("CHROM_SIZES_PATH")
+	if assembly == "" || sizesPath == "" {
+		log.Fatal("ASSEMBLY_NAME (or GENOME_ASSEMBLY) and CHROM_SIZES_PATH must be set to load an assembly.")
+	}
+
+	// Databases from before assemblies lack their tables.
+	err := RunMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = LoadChromSizes(assembly, sizesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	aliasPath, set := os.LookupEnv("CHROM_ALIAS_PATH")
+	if set {
+		err = LoadChromAliases(assembly, aliasPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("[Info] Loaded assembly %s.\n", assembly)
+
+	// Other commands in this run should normalize against the new assembly.
+	err = UseAssembly(assembly)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/** HTTP Routes **/
+
+func handleGetAssembly(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	assembly, err := GetAssembly(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Assemblies.")
+		return
+	}
+
+	json.NewEncoder(w).Encode(assembly)
+}
+
+func handleGetAssemblyChromosomes(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	assembly, err := GetAssembly(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Assemblies.")
+		return
+	}
+
+	serveList[Chromosome](w, r, chromosomeList, "Chromosomes", "SELECT * FROM Chromosomes WHERE Assembly=?", assembly.Name)
+}
+
+func handleGetAssemblyAliases(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	assembly, err := GetAssembly(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Assemblies.")
+		return
+	}
+
+	aliases, err := assembly.GetAliases()
+	if err != nil {
+		writeError(w, err, "Could not fetch Chromosome Aliases.")
+		return
+	}
+
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func init() {
+	registerRoute(Route{path: "/assemblies", handler: handleListGeneric[Assembly](assemblyList, "Assemblies", "SELECT * FROM Assemblies"), method: "GET",
+		summary: "List genome assemblies", response: []Assembly{}, list: &assemblyList})
+	registerRoute(Route{path: "/assemblies/{name}", handler: handleGetAssembly, method: "GET",
+		summary: "Get a genome assembly", response: Assembly{}})
+	registerRoute(Route{path: "/assemblies/{name}/chromosomes", handler: handleGetAssemblyChromosomes, method: "GET",
+		summary: "List the chromosomes of an assembly", response: []Chromosome{}, list: &chromosomeList})
+	registerRoute(Route{path: "/assemblies/{name}/aliases", handler: handleGetAssemblyAliases, method: "GET",
+		summary: "List the chromosome aliases of an assembly", response: []ChromosomeAlias{}})
+	registerCommand(Command{"RUN_ASSEMBLY_LOADER", RunAssemblyLoader})
+
+	// In order, as each references the one before.
+	registerMigration(createTableMigration("Assemblies", `CREATE TABLE Assemblies (
+		Name varchar(255) primary key NOT NULL
+	)`))
+	registerMigration(createTableMigration("Chromosomes", `CREATE TABLE Chromosomes (
+		Assembly varchar(255) NOT NULL,
+		Name varchar(255) NOT NULL,
+		Length INT NOT NULL,
+		PRIMARY KEY (Assembly, Name),
+		FOREIGN KEY (Assembly) REFERENCES Assemblies(Name),
+		CHECK (Length > 0)
+	)`))
+	registerMigration(createTableMigration("ChromosomeAliases", `CREATE TABLE ChromosomeAliases (
+		Assembly varchar(255) NOT NULL,
+		Alias varchar(255) NOT NULL,
+		Chromosome varchar(255) NOT NULL,
+		PRIMARY KEY (Assembly, Alias),
+		FOREIGN KEY (Assembly, Chromosome) REFERENCES Chromosomes(Assembly, Name)
+	)`))
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,6 +15,11 @@ type CellType struct {
 	Type string `json:"Type" db:"Type"`
 }
 
+var cellTypeList = ListSpec{
+	Fields: map[string]ListField{"type": {"Type", fieldString}},
+	Order:  "Type",
+}
+
 /** SQL Helpers **/
 
 func GetCellTypes() ([]CellType, error) {
@@ -58,7 +63,7 @@ func GetCellType(t string) (CellType, error) {
 	}
 
 	// No results found.
-	return CellType{}, errors.New("not_found")
+	return CellType{}, notFound("Cell Type")
 }
 
 /*
@@ -67,13 +72,13 @@ Saves changes to an existing CellType
 func (c CellType) Save(oldType string) (err error) {
 	query := `UPDATE CellTypes SET Type = ? WHERE Type = ?;`
 	_, err = db.Exec(query, c.Type, oldType)
-	return
+	return dbError(err)
 }
 
 func (c CellType) Delete() (err error) {
 	query := `DELETE FROM CellTypes WHERE Type = ?`
 	_, err = db.Exec(query, c.Type)
-	return
+	return dbError(err)
 }
 
 /** HTTP Routes **/
@@ -83,8 +88,7 @@ func handleCreateCellTypes(w http.ResponseWriter, r *http.Request) {
 	result := make([]CellType, 0)
 	err := json.NewDecoder(r.Body).Decode(&result)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Body must be an array of Cell Types.")
+		writeBadRequest(w, "Body must be an array of Cell Types.")
 		return
 	}
 
@@ -102,15 +106,13 @@ func handleCreateCellTypes(w http.ResponseWriter, r *http.Request) {
 	statement, err := db.Prepare(query)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not create SQL statement.")
+		writeError(w, err, "Could not create SQL statement.")
 		return
 	}
 
 	_, err = statement.Exec(args...)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err.Error())
+		writeError(w, err, "Could not create Cell Types.")
 		return
 	}
 
@@ -123,21 +125,14 @@ func handleGetCellType(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Cell Type.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Unable to fetch Cell Type.")
-		}
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(cell)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not format cell type for response.")
+		writeError(w, err, "Could not format cell type for response.")
 	}
 }
 
@@ -145,30 +140,21 @@ func handleEditCellType(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Cell Type.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Unable to fetch Cell Types.")
-		}
+		writeError(w, err, "Unable to fetch Cell Types.")
 		return
 	}
 
 	var newCell CellType
 	err = json.NewDecoder(r.Body).Decode(&newCell)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Body must be a Cell Type")
+		writeBadRequest(w, "Body must be a Cell Type")
 		return
 	}
 
 	// Update cell with values in body, provided the type of the old.
 	err = newCell.Save(cell.Type)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not update Cell Type.")
-		fmt.Println(err.Error())
+		writeError(w, err, "Could not update Cell Type.")
 	}
 }
 
@@ -176,15 +162,13 @@ func handleDeleteCellType(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
 	err = cell.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Cell Type.")
+		writeError(w, err, "Could not delete Cell Type.")
 		return
 	}
 
@@ -195,61 +179,54 @@ func handleGetMotifInstancesInCellType(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
-		return
-	}
-
-	instances, err := cell.GetMotifInstances()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Motif Instances.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(instances)
+	serveList[MotifInstance](w, r, motifInstanceList, "Motif Instances", motifInstanceWithLengthQuery+" WHERE MI.CellType=?", cell.Type)
 }
 
 func handleGetInteractionsInCellType(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
-	interactions, err := cell.GetInteractions()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Interactions")
-		return
-	}
-
-	json.NewEncoder(w).Encode(interactions)
+	serveList[Interaction](w, r, interactionList, "Interactions", interactionsQuery("I.CellType=?", ""), cell.Type)
 }
 
 func handleCreateInteraction(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+
+	// The body is optional, an empty one creates an interaction without loci.
+	var it Interaction
+	err = json.NewDecoder(r.Body).Decode(&it)
+	if err != nil && err != io.EOF {
+		writeBadRequest(w, "Request body should be an Interaction with its Loci, or empty.")
 		return
 	}
+	it.CellType = cell.Type
 
-	// No need for JSON, just use the cell type and create an interaction.
-	// Function will return the new ID.
-	it := Interaction{CellType: cell.Type}
 	newid, err := it.Create()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not create Interaction.\n", err.Error())
+		writeError(w, err, "Could not create Interaction.")
+		return
+	}
+
+	it, err = GetInteraction(newid)
+	if err != nil {
+		writeError(w, err, "Created Interaction, but could not fetch it.")
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	it.ID = newid
 	json.NewEncoder(w).Encode(it)
 }
 
@@ -257,29 +234,25 @@ func handleDeleteCellTypeMotif(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
 	start, err := strconv.ParseInt(v["start"], 10, 32)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Start field is invalid. Must be an integer.")
+		writeBadRequest(w, "Start field is invalid. Must be an integer.")
 		return
 	}
 
-	inst, err := GetMotifInstance(cell.Type, v["chr"], int(start))
+	inst, err := GetMotifInstance(cell.Type, normalizeChrName(v["chr"]), int(start))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Motif Instances.")
+		writeError(w, err, "Could not fetch Motif Instances.")
 		return
 	}
 
 	err = inst.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Motif Instance.")
+		writeError(w, err, "Could not delete Motif Instance.")
 		return
 	}
 
@@ -290,78 +263,63 @@ func handleGetGeneExpressions(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
-		return
-	}
-
-	expresesions, err := cell.GeneExpressions()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Gene Expressions.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(expresesions)
+	serveList[GeneExpression](w, r, geneExpressionList, "Gene Expressions", "SELECT * FROM GeneExpression WHERE CellType=?", cell.Type)
 }
 
 func handleEditGeneExpression(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
 	_, err = cell.GeneExpression(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene Expression.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Gene Expressions.")
-		}
+		writeError(w, err, "Could not fetch Gene Expressions.")
 		return
 	}
 
 	var newExpression GeneExpression
 	err = json.NewDecoder(r.Body).Decode(&newExpression)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body should be a Gene Expression")
+		writeBadRequest(w, "Request body should be a Gene Expression")
 		return
 	}
 
-	newExpression.Save()
+	// The path names the expression being edited, whatever the body says.
+	newExpression.CellType = cell.Type
+	newExpression.Gene = v["name"]
+	err = newExpression.Save()
+	if err != nil {
+		writeError(w, err, "Could not update Gene Expression.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 func handleDeleteGeneExpression(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	cell, err := GetCellType(v["type"])
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Could not find Cell Type.")
+		writeError(w, err, "Unable to fetch Cell Type.")
 		return
 	}
 
 	expression, err := cell.GeneExpression(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene Expression.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Gene Expressions.")
-		}
+		writeError(w, err, "Could not fetch Gene Expressions.")
 		return
 	}
 
 	err = expression.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Gene Expression.")
+		writeError(w, err, "Could not delete Gene Expression.")
 		return
 	}
 
@@ -369,16 +327,28 @@ func handleDeleteGeneExpression(w http.ResponseWriter, r *http.Request) {
 }
 
 func init() {
-	registerRoute(Route{"/celltypes", handleGetGeneric(GetCellTypes), "GET"})
-	registerRoute(Route{"/celltypes", handleCreateCellTypes, "POST"})
-	registerRoute(Route{"/celltypes/{type}", handleGetCellType, "GET"})
-	registerRoute(Route{"/celltypes/{type}", handleEditCellType, "PUT"})
-	registerRoute(Route{"/celltypes/{type}", handleDeleteCellType, "DELETE"})
-	registerRoute(Route{"/celltypes/{type}/motifs", handleGetMotifInstancesInCellType, "GET"})
-	registerRoute(Route{"/celltypes/{type}/motifs/{chr}/{start}", handleDeleteCellTypeMotif, "DELETE"})
-	registerRoute(Route{"/celltypes/{type}/interactions", handleGetInteractionsInCellType, "GET"})
-	registerRoute(Route{"/celltypes/{type}/interactions", handleCreateInteraction, "POST"})
-	registerRoute(Route{"/celltypes/{type}/genes", handleGetGeneExpressions, "GET"})
-	registerRoute(Route{"/celltypes/{type}/genes/{name}", handleEditGeneExpression, "PUT"})
-	registerRoute(Route{"/celltypes/{tpye}/genes/{name}", handleDeleteGeneExpression, "DELETE"})
+	registerRoute(Route{path: "/celltypes", handler: handleListGeneric[CellType](cellTypeList, "Cell Types", "SELECT * FROM CellTypes"), method: "GET",
+		summary: "List cell types", response: []CellType{}, list: &cellTypeList})
+	registerRoute(Route{path: "/celltypes", handler: handleCreateCellTypes, method: "POST",
+		summary: "Create cell types", body: []CellType{}})
+	registerRoute(Route{path: "/celltypes/{type}", handler: handleGetCellType, method: "GET",
+		summary: "Get a cell type", response: CellType{}})
+	registerRoute(Route{path: "/celltypes/{type}", handler: handleEditCellType, method: "PUT",
+		summary: "Rename a cell type", body: CellType{}})
+	registerRoute(Route{path: "/celltypes/{type}", handler: handleDeleteCellType, method: "DELETE",
+		summary: "Delete a cell type"})
+	registerRoute(Route{path: "/celltypes/{type}/motifs", handler: handleGetMotifInstancesInCellType, method: "GET",
+		summary: "List the motif instances of a cell type", response: []MotifInstance{}, list: &motifInstanceList})
+	registerRoute(Route{path: "/celltypes/{type}/motifs/{chr}/{start}", handler: handleDeleteCellTypeMotif, method: "DELETE",
+		summary: "Delete a motif instance of a cell type"})
+	registerRoute(Route{path: "/celltypes/{type}/interactions", handler: handleGetInteractionsInCellType, method: "GET",
+		summary: "List the interactions of a cell type", response: []Interaction{}, list: &interactionList})
+	registerRoute(Route{path: "/celltypes/{type}/interactions", handler: handleCreateInteraction, method: "POST",
+		summary: "Create an interaction in a cell type, along with any of its loci which do not exist", body: Interaction{}, response: Interaction{}})
+	registerRoute(Route{path: "/celltypes/{type}/genes", handler: handleGetGeneExpressions, method: "GET",
+		summary: "List gene expression levels of a cell type", response: []GeneExpression{}, list: &geneExpressionList})
+	registerRoute(Route{path: "/celltypes/{type}/genes/{name}", handler: handleEditGeneExpression, method: "PUT",
+		summary: "Set the expression level of a gene in a cell type", body: GeneExpression{}})
+	registerRoute(Route{path: "/celltypes/{type}/genes/{name}", handler: handleDeleteGeneExpression, method: "DELETE",
+		summary: "Delete the expression level of a gene in a cell type"})
 }
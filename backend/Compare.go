@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+Comparisons
+Interactions of two cell types are matched on their anchor sets. Two
+interactions match when they have the same number of anchors and, with both
+sets in order, each pair of anchors is on the same chromosome with starts and
+ends no more than the tolerance apart. Each interaction matches at most one
+of the other cell type.
+**/
+
+// Two matching interactions, one of each cell type.
+type InteractionPair struct {
+	A Interaction `json:"A"`
+	B Interaction `json:"B"`
+}
+
+// Counts of one chromosome. Interactions count towards every chromosome they have an anchor on.
+type ChromosomeComparison struct {
+	Chr    string `json:"Chr"`
+	Shared int    `json:"Shared"`
+	OnlyA  int    `json:"OnlyA"`
+	OnlyB  int    `json:"OnlyB"`
+}
+
+type ComparisonSummary struct {
+	CountA int `json:"CountA"`
+	CountB int `json:"CountB"`
+	Shared int `json:"Shared"`
+	OnlyA  int `json:"OnlyA"`
+	OnlyB  int `json:"OnlyB"`
+	// Shared over the number of distinct interactions, counting each pair once.
+	Jaccard     float64                `json:"Jaccard"`
+	Chromosomes []ChromosomeComparison `json:"Chromosomes"`
+}
+
+type InteractionComparison struct {
+	A         string            `json:"A"`
+	B         string            `json:"B"`
+	Tolerance int               `json:"Tolerance"`
+	Region    *Region           `json:"Region,omitempty"`
+	Shared    []InteractionPair `json:"Shared"`
+	OnlyA     []Interaction     `json:"OnlyA"`
+	OnlyB     []Interaction     `json:"OnlyB"`
+	Summary   ComparisonSummary `json:"Summary"`
+}
+
+/*
+Returns the interactions of a cell type passing the filter with their loci,
+limited to those with an anchor overlapping the region when it is given.
+*/
+func interactionsToCompare(celltype string, region *Region, filter InteractionFilter) (its []Interaction, err error) {
+	where := `I.CellType=?`
+	args := []interface{}{celltype}
+	if region != nil {
+		clause, overlapArgs := overlapClause("RL", "RL.End", region.Chr, region.Start, region.End)
+		where += ` AND I.ID IN (SELECT RP.Interaction FROM InteractionParticipation AS RP
+			INNER JOIN Loci AS RL ON RL.ID=RP.Locus WHERE ` + clause + `)`
+		args = append(args, overlapArgs...)
+	}
+
+	having, havingArgs := filter.having()
+	rows, err := db.Queryx(interactionsQuery(where, having)+` ORDER BY I.ID`, append(args, havingArgs...)...)
+	if err != nil {
+		return []Interaction{}, err
+	}
+	defer rows.Close()
+
+	its = make([]Interaction, 0)
+	for rows.Next() {
+		var it Interaction
+		err = rows.StructScan(&it)
+		if err != nil {
+			return its, err
+		}
+		its = append(its, it)
+	}
+	if err = rows.Err(); err != nil {
+		return its, err
+	}
+
+	err = fillInteractionLoci(its)
+	return
+}
+
+// Interactions which can only match each other share a key: their anchor count and chromosomes.
+func anchorKey(it Interaction) string {
+	chrs := make([]string, len(it.Loci))
+	for i, l := range it.Loci {
+		chrs[i] = l.Chr
+	}
+	return strconv.Itoa(len(it.Loci)) + "|" + strings.Join(chrs, ",")
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Whether two interactions of the same key have anchors within tolerance of each other.
+func anchorsMatch(a Interaction, b Interaction, tolerance int) bool {
+	for i := range a.Loci {
+		if abs(a.Loci[i].Start-b.Loci[i].Start) > tolerance || abs(a.Loci[i].End-b.Loci[i].End) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches interactions of a against those of b, each being used at most once.
+func matchInteractions(a []Interaction, b []Interaction, tolerance int) (shared []InteractionPair, onlyA []Interaction, onlyB []Interaction) {
+	// Candidates of b are grouped by key and sorted by the start of their first
+	// anchor, so only those close enough to each interaction of a are checked.
+	groups := make(map[string][]int)
+	for j, it := range b {
+		key := anchorKey(it)
+		groups[key] = append(groups[key], j)
+	}
+	firstStart := func(it Interaction) int {
+		if len(it.Loci) == 0 {
+			return 0
+		}
+		return it.Loci[0].Start
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(x, y int) bool { return firstStart(b[group[x]]) < firstStart(b[group[y]]) })
+	}
+
+	used := make([]bool, len(b))
+	shared = make([]InteractionPair, 0)
+	onlyA = make([]Interaction, 0)
+	for _, it := range a {
+		group := groups[anchorKey(it)]
+		start := firstStart(it)
+		matched := false
+		for k := sort.Search(len(group), func(k int) bool { return firstStart(b[group[k]]) >= start-tolerance }); k < len(group); k++ {
+			j := group[k]
+			if firstStart(b[j]) > start+tolerance {
+				break
+			}
+			if !used[j] && anchorsMatch(it, b[j], tolerance) {
+				used[j] = true
+				shared = append(shared, InteractionPair{it, b[j]})
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			onlyA = append(onlyA, it)
+		}
+	}
+
+	onlyB = make([]Interaction, 0)
+	for j, it := range b {
+		if !used[j] {
+			onlyB = append(onlyB, it)
+		}
+	}
+	return
+}
+
+func chromosomesOf(it Interaction) []string {
+	seen := make(map[string]bool)
+	chrs := make([]string, 0)
+	for _, l := range it.Loci {
+		if !seen[l.Chr] {
+			seen[l.Chr] = true
+			chrs = append(chrs, l.Chr)
+		}
+	}
+	return chrs
+}
+
+func summarizeComparison(c InteractionComparison) ComparisonSummary {
+	s := ComparisonSummary{
+		CountA: len(c.Shared) + len(c.OnlyA),
+		CountB: len(c.Shared) + len(c.OnlyB),
+		Shared: len(c.Shared),
+		OnlyA:  len(c.OnlyA),
+		OnlyB:  len(c.OnlyB),
+	}
+	if union := s.Shared + s.OnlyA + s.OnlyB; union > 0 {
+		s.Jaccard = float64(s.Shared) / float64(union)
+	}
+
+	counts := make(map[string]*ChromosomeComparison)
+	count := func(it Interaction, add func(*ChromosomeComparison)) {
+		for _, chr := range chromosomesOf(it) {
+			if counts[chr] == nil {
+				counts[chr] = &ChromosomeComparison{Chr: chr}
+			}
+			add(counts[chr])
+		}
+	}
+	for _, pair := range c.Shared {
+		count(pair.A, func(cc *ChromosomeComparison) { cc.Shared++ })
+	}
+	for _, it := range c.OnlyA {
+		count(it, func(cc *ChromosomeComparison) { cc.OnlyA++ })
+	}
+	for _, it := range c.OnlyB {
+		count(it, func(cc *ChromosomeComparison) { cc.OnlyB++ })
+	}
+
+	s.Chromosomes = make([]ChromosomeComparison, 0, len(counts))
+	for _, cc := range counts {
+		s.Chromosomes = append(s.Chromosomes, *cc)
+	}
+	sort.Slice(s.Chromosomes, func(i, j int) bool { return s.Chromosomes[i].Chr < s.Chromosomes[j].Chr })
+	return s
+}
+
+// Compares the interactions of two cell types passing the filter, optionally within a region.
+func CompareInteractions(a string, b string, tolerance int, region *Region, filter InteractionFilter) (c InteractionComparison, err error) {
+	c = InteractionComparison{A: a, B: b, Tolerance: tolerance, Region: region}
+
+	itsA, err := interactionsToCompare(a, region, filter)
+	if err != nil {
+		return
+	}
+	itsB, err := interactionsToCompare(b, region, filter)
+	if err != nil {
+		return
+	}
+
+	c.Shared, c.OnlyA, c.OnlyB = matchInteractions(itsA, itsB, tolerance)
+	c.Summary = summarizeComparison(c)
+	return
+}
+
+/** HTTP Routes **/
+
+func handleCompareInteractions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	for _, name := range []string{"a", "b"} {
+		if q.Get(name) == "" {
+			writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("%s must be given as the name of a Cell Type.", name))
+			return
+		}
+		_, err := GetCellType(q.Get(name))
+		if err != nil {
+			writeError(w, err, "Unable to fetch Cell Type.")
+			return
+		}
+	}
+
+	tolerance := 0
+	if raw := q.Get("tolerance"); raw != "" {
+		var err error
+		tolerance, err = strconv.Atoi(raw)
+		if err != nil || tolerance < 0 {
+			writeProblem(w, http.StatusBadRequest, "invalid_parameter", "tolerance must be a non-negative integer.")
+			return
+		}
+	}
+
+	var region *Region
+	if q.Get("region") != "" && q.Get("gene") != "" {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Only one of region and gene may be given.")
+		return
+	}
+	if raw := q.Get("region"); raw != "" {
+		parsed, err := ParseRegion(raw)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "invalid_region", err.Error())
+			return
+		}
+		region = &parsed
+	}
+	if name := q.Get("gene"); name != "" {
+		gene, err := GetGene(name)
+		if err != nil {
+			writeError(w, err, "Could not fetch Genes.")
+			return
+		}
+		region = &Region{Chr: gene.Chr, Start: gene.Start, End: gene.End}
+	}
+
+	filter, err := parseInteractionFilter(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	c, err := CompareInteractions(q.Get("a"), q.Get("b"), tolerance, region, filter)
+	if err != nil {
+		writeError(w, err, "Could not compare Interactions.")
+		return
+	}
+
+	json.NewEncoder(w).Encode(c)
+}
+
+func init() {
+	registerRoute(Route{path: "/compare/interactions", handler: handleCompareInteractions, method: "GET",
+		summary: "Compare the interactions of two cell types", response: InteractionComparison{}, query: append([]string{"a", "b", "tolerance", "region", "gene"}, interactionFilterParams...)})
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -19,29 +22,117 @@ func GeneExists(Name string) bool {
 	return (err == nil)
 }
 
-func LocusFromID(ID string) Locus {
-	colonPos := strings.Index(ID, ":")
-	dashPos := strings.Index(ID, "-")
-
-	chr := ID[:colonPos-1]
-	startStr := ID[colonPos+1 : dashPos-1]
-	endStr := ID[dashPos+1:]
-
-	start, err := strconv.ParseInt(startStr, 10, 32)
+func LocusFromID(ID string) (Locus, error) {
+	r, err := ParseRegion(ID)
 	if err != nil {
-		log.Panic(err)
+		return Locus{}, err
 	}
-	end, err := strconv.ParseInt(endStr, 10, 32)
+	return r.Locus(), nil
+}
+
+// Parses a locus ID from a data file, creating the Locus if it doesn't already exist.
+// Returns the canonical ID to reference it by.
+func ensureLocus(ID string) (string, error) {
+	l, err := LocusFromID(ID)
 	if err != nil {
-		log.Panic(err)
+		return "", err
+	}
+	if !LocusExist(l.ID) {
+		err = l.Create()
 	}
+	return l.ID, err
+}
+
+/*
+Columns of interaction files holding attributes rather than anchors, by their
+name in a header line. Files without a header give the anchors first, then
+any of ContactCount, PValue, QValue and Caller in that order.
+*/
+var interactionAttributeColumns = map[string]string{
+	"contactcount": "ContactCount", "count": "ContactCount", "contacts": "ContactCount",
+	"pvalue": "PValue", "p": "PValue", "p_value": "PValue", "pval": "PValue",
+	"qvalue": "QValue", "q": "QValue", "q_value": "QValue", "qval": "QValue", "fdr": "QValue",
+	"caller": "Caller", "method": "Caller",
+}
+
+var interactionAttributeOrder = []string{"ContactCount", "PValue", "QValue", "Caller"}
 
-	return Locus{
-		ID:    ID,
-		Chr:   chr,
-		Start: int(start),
-		End:   int(end),
+// Sets an attribute of an interaction from a column. Empty, "." and "NA" values are left null.
+func setInteractionAttribute(it *Interaction, attribute string, value string) error {
+	if value == "" || value == "." || value == "NA" {
+		return nil
 	}
+	switch attribute {
+	case "ContactCount":
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("ContactCount %q is not an integer", value)
+		}
+		it.ContactCount = &count
+	case "PValue", "QValue":
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s %q is not a number", attribute, value)
+		}
+		if attribute == "PValue" {
+			it.PValue = &x
+		} else {
+			it.QValue = &x
+		}
+	case "Caller":
+		it.Caller = &value
+	}
+	return nil
+}
+
+/*
+Reads an interaction from a record. Columns maps each column to its attribute,
+or to "" for an anchor. Without columns, leading fields are anchors as long as
+they parse as loci, and the rest attributes in interactionAttributeOrder. Empty
+fields are then padding, such as the unused anchor columns of n-wise files, so
+an attribute left out before another one must be written "." or "NA".
+*/
+func parseInteractionRecord(ct string, rec []string, columns []string) (Interaction, error) {
+	it := Interaction{CellType: ct, Loci: make([]Locus, 0, len(rec))}
+	attributes := 0
+	for i, field := range rec {
+		if columns == nil && field == "" {
+			continue
+		}
+		attribute := ""
+		if columns != nil && i < len(columns) {
+			attribute = columns[i]
+		} else if columns == nil && (attributes > 0 || !isLocusID(field)) {
+			if attributes >= len(interactionAttributeOrder) {
+				return it, fmt.Errorf("too many columns after the anchors")
+			}
+			attribute = interactionAttributeOrder[attributes]
+			attributes++
+		}
+
+		if attribute != "" {
+			err := setInteractionAttribute(&it, attribute, field)
+			if err != nil {
+				return it, err
+			}
+			continue
+		}
+		// N-wise interactions may leave trailing anchor columns empty.
+		if field == "" {
+			continue
+		}
+		l, err := LocusFromID(field)
+		if err != nil {
+			return it, err
+		}
+		it.Loci = append(it.Loci, l)
+	}
+	return it, nil
+}
+
+func isLocusID(field string) bool {
+	_, err := ParseRegion(field)
+	return err == nil
 }
 
 func ImportInteractions(ct string, Filename string) {
@@ -52,8 +143,12 @@ func ImportInteractions(ct string, Filename string) {
 	defer f.Close()
 
 	csvReader := csv.NewReader(f)
-	csvReader.Comma = '\t' // Tab delimmtted
-	for {
+	csvReader.Comma = '\t'         // Tab delimmtted
+	csvReader.FieldsPerRecord = -1 // Interactions may have any number of anchors.
+	interactions := make([]Interaction, 0)
+	lines := make([]int, 0)
+	var columns []string
+	for line := 1; ; line++ {
 		rec, err := csvReader.Read()
 		if err == io.EOF {
 			break
@@ -62,22 +157,37 @@ func ImportInteractions(ct string, Filename string) {
 			log.Fatal(err)
 		}
 
+		// A first line not starting with a locus names the columns.
+		if line == 1 && len(rec) > 0 && !isLocusID(rec[0]) {
+			columns = make([]string, len(rec))
+			for i, name := range rec {
+				columns[i] = interactionAttributeColumns[strings.ToLower(strings.TrimLeft(strings.TrimSpace(name), "#"))]
+			}
+			continue
+		}
+
 		// Now have rec, which contains the data from the line.
-		tempint := Interaction{CellType: ct}
-		newid, err := tempint.Create()
-		tempint.ID = newid
+		// Support for n-wise interactions.
+		tempint, err := parseInteractionRecord(ct, rec, columns)
 		if err != nil {
-			log.Fatal(err) // Shouldn't be any reason this fails that isn't fatal.
+			log.Fatalf("%s line %d: %s", Filename, line, err)
 		}
 
-		// Support for n-wise interactions.
-		for i := 0; i < len(rec); i++ {
-			if !LocusExist(rec[i]) {
-				LocusFromID(rec[i]).Create() // Create the Locus if it doesn't already exist.
-			}
-			tempint.AddLocus(rec[i]) // Add the locus to the new interaction.
+		interactions = append(interactions, tempint)
+		lines = append(lines, line)
+	}
+
+	// Missing loci are created along with the interactions, all in one transaction.
+	_, err = CreateInteractions(interactions)
+	var bulk BulkError
+	if errors.As(err, &bulk) {
+		for _, item := range bulk.Items {
+			log.Printf("%s line %d: %s", Filename, lines[item.Index], item.Detail)
 		}
 	}
+	if err != nil {
+		log.Fatal(err) // Shouldn't be any reason this fails that isn't fatal.
+	}
 }
 
 // This is currently hardcoded for the type of file we have.
@@ -110,7 +220,7 @@ func ImportGeneExpressions(Filename string) {
 			if err != nil {
 				log.Fatal(err)
 			}
-			Gene{Name: name, Chr: rec[0], Start: int(start), End: int(end)}.Create()
+			Gene{Name: name, Chr: rec[1], Start: int(start), End: int(end)}.Create()
 		}
 
 		// Now we know the gene exists, create expressions for either cell type.
@@ -151,8 +261,9 @@ func ImportMotifInstances(ct string, Filename string) {
 		}
 
 		// Column 3 is the Locus ID.
-		if !LocusExist(rec[3]) {
-			LocusFromID(rec[3]).Create() // Create if non-existent.
+		locusID, err := ensureLocus(rec[3])
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		// Otherwise, just parse everything.
@@ -166,7 +277,7 @@ func ImportMotifInstances(ct string, Filename string) {
 		}
 		forward := strIsForw(rec[9])
 
-		MotifInstance{CellType: ct, Model: rec[7], Start: int(start), ThresholdScore: threshold, Chr: rec[4], Forward: forward, LocusID: rec[3]}.Create()
+		MotifInstance{CellType: ct, Model: rec[7], Start: int(start), ThresholdScore: threshold, Chr: normalizeChrName(rec[4]), Forward: forward, LocusID: locusID}.Create()
 	}
 }
 
@@ -202,12 +313,87 @@ func ImportMotifModels(Filename string) {
 	}
 }
 
+// The format and kind of a matrix file by its extension, the kind being guessed when empty.
+var matrixFileFormats = map[string][2]string{
+	".pcm":    {formatHOCOMOCO, matrixCounts},
+	".pwm":    {formatHOCOMOCO, matrixWeights},
+	".jaspar": {formatJASPAR, ""},
+	".pfm":    {formatJASPAR, ""},
+	".meme":   {formatMEME, ""},
+}
+
+/*
+Imports the matrix files of a directory, if it exists. Motifs are matched to
+Motif Models by any of their names in the file, or by the file name when the
+file leaves them out. Motifs without a model, or of the wrong width, are skipped.
+*/
+func ImportMotifMatrices(Dir string) {
+	entries, err := os.ReadDir(Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		format, ok := matrixFileFormats[strings.ToLower(extension)]
+		if entry.IsDir() || !ok {
+			continue
+		}
+		text, err := os.ReadFile(filepath.Join(Dir, entry.Name()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		motifs, err := ParseMotifMatrices(format[0], format[1], string(text))
+		if err != nil {
+			log.Fatalf("%s: %s", entry.Name(), err)
+		}
+
+		for _, motif := range motifs {
+			names := motif.Names
+			if len(names) == 0 {
+				names = []string{strings.TrimSuffix(entry.Name(), extension)}
+			}
+			var mm MotifModel
+			for _, name := range names {
+				mm, err = GetMotifModel(name)
+				if err == nil {
+					break
+				}
+			}
+			if err != nil {
+				fmt.Printf("[Warn] Skipping motif %s of %s, which is no Motif Model.\n", names[0], entry.Name())
+				continue
+			}
+
+			for _, m := range motif.Matrices {
+				m.Model = mm.Name
+				err = m.Save()
+				if errors.Is(err, ErrValidation) {
+					fmt.Printf("[Warn] Skipping motif %s of %s: %s\n", names[0], entry.Name(), err)
+					continue
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
 func RunDataLoader() {
 	// This assumes the cell types DN and PGN have already been imported through other means.
 	ImportMotifModels("./motif_models.tsv")
+	ImportMotifMatrices("./motif_matrices")
 	ImportInteractions("DN", "./dn_interactions.tsv")
 	ImportInteractions("PGN", "./pgn_interactions.tsv")
 	ImportMotifInstances("DN", "./dn_motifs.bed")
 	ImportMotifInstances("PGN", "./pgn_motifs.bed")
 	ImportGeneExpressions("./gene_expressions.csv")
 }
+
+func init() {
+	registerCommand(Command{"RUN_DB_LOADER", RunDataLoader})
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestParseInteractionRecord(t *testing.T) {
+	type want struct {
+		loci   int
+		count  *int
+		pValue *float64
+		qValue *float64
+		caller *string
+	}
+	five, half, tenth, hiccups := 5, 0.5, 0.1, "hiccups"
+	tests := []struct {
+		name    string
+		rec     []string
+		columns []string
+		want    want
+		wantErr bool
+	}{
+		{"anchors only", []string{"chrX:0-2000", "chrX:4000-6000"}, nil, want{loci: 2}, false},
+		{"padded anchors", []string{"chrX:0-2000", "chrX:4000-6000", "", "", "", ""}, nil, want{loci: 2}, false},
+		{"attributes", []string{"chrX:0-2000", "chrX:4000-6000", "5", "0.5", "0.1", "hiccups"}, nil,
+			want{2, &five, &half, &tenth, &hiccups}, false},
+		{"attributes after padding", []string{"chrX:0-2000", "chrX:4000-6000", "", "", "5", "0.5"}, nil,
+			want{loci: 2, count: &five, pValue: &half}, false},
+		{"left out attribute", []string{"chrX:0-2000", "chrX:4000-6000", "", ".", "0.5", "NA", "hiccups"}, nil,
+			want{loci: 2, pValue: &half, caller: &hiccups}, false},
+		{"too many attributes", []string{"chrX:0-2000", "chrX:4000-6000", "5", "0.5", "0.1", "hiccups", "x"}, nil, want{}, true},
+		{"bad count", []string{"chrX:0-2000", "chrX:4000-6000", "five"}, nil, want{}, true},
+		{"header", []string{"chrX:0-2000", "chrX:4000-6000", "", "0.1"}, []string{"", "", "", "QValue"},
+			want{loci: 2, qValue: &tenth}, false},
+		{"header with empty attribute", []string{"chrX:0-2000", "chrX:4000-6000", "", "hiccups"}, []string{"", "", "ContactCount", "Caller"},
+			want{loci: 2, caller: &hiccups}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it, err := parseInteractionRecord("Test", tt.rec, tt.columns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(it.Loci) != tt.want.loci {
+				t.Errorf("%d loci, want %d", len(it.Loci), tt.want.loci)
+			}
+			if !equalPointers(it.ContactCount, tt.want.count) || !equalPointers(it.PValue, tt.want.pValue) ||
+				!equalPointers(it.QValue, tt.want.qValue) || !equalPointers(it.Caller, tt.want.caller) {
+				t.Errorf("attributes = %v %v %v %v, want %v %v %v %v",
+					it.ContactCount, it.PValue, it.QValue, it.Caller, tt.want.count, tt.want.pValue, tt.want.qValue, tt.want.caller)
+			}
+		})
+	}
+}
+
+func equalPointers[T comparable](a *T, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
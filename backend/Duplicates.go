@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/**
+Duplicate interactions
+Interactions of a cell type are unique by their signature, the canonical form
+of their anchor set (see interactionSignature). Creating a duplicate adds to
+the SupportCount of the existing interaction instead. Databases loaded before
+signatures existed may hold duplicates, which are merged into the interaction
+of lowest ID, summing their support, before the unique index is created. As
+when creating a duplicate, attributes it lacks are taken from the others.
+**/
+
+/*
+Recomputes the signature of every interaction and merges those sharing one
+within a cell type. Returns the number of interactions merged away.
+*/
+func MergeDuplicateInteractions(tx *sqlx.Tx) (merged int, err error) {
+	its := make([]Interaction, 0)
+	err = tx.Select(&its, "SELECT CellType, ID, SupportCount, ContactCount, PValue, QValue, Caller FROM Interactions ORDER BY ID")
+	if err != nil {
+		return 0, err
+	}
+
+	loci := make(map[int64][]Locus)
+	rows, err := tx.Queryx("SELECT P.Interaction, L.* FROM InteractionParticipation AS P INNER JOIN Loci AS L ON L.ID=P.Locus")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var a anchorRow
+		err = rows.StructScan(&a)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		loci[a.Interaction] = append(loci[a.Interaction], a.Locus)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Signatures are cleared first, so that setting them cannot collide with stale ones.
+	_, err = tx.Exec("UPDATE Interactions SET Signature=NULL")
+	if err != nil {
+		return 0, err
+	}
+
+	kept := make(map[string]int)
+	for i, it := range its {
+		signature := interactionSignature(loci[it.ID])
+		if signature == nil {
+			continue
+		}
+		key := it.CellType + "\x00" + *signature
+		keeper, seen := kept[key]
+		if !seen {
+			kept[key] = i
+			continue
+		}
+
+		keep := &its[keeper]
+		keep.SupportCount += it.SupportCount
+		if keep.ContactCount == nil {
+			keep.ContactCount = it.ContactCount
+		}
+		if keep.PValue == nil {
+			keep.PValue = it.PValue
+		}
+		if keep.QValue == nil {
+			keep.QValue = it.QValue
+		}
+		if keep.Caller == nil {
+			keep.Caller = it.Caller
+		}
+		_, err = tx.Exec("DELETE FROM InteractionParticipation WHERE Interaction=?", it.ID)
+		if err != nil {
+			return merged, err
+		}
+		_, err = tx.Exec("DELETE FROM Interactions WHERE ID=?", it.ID)
+		if err != nil {
+			return merged, err
+		}
+		merged++
+	}
+
+	for _, i := range kept {
+		it := its[i]
+		_, err = tx.Exec("UPDATE Interactions SET Signature=?, SupportCount=?, ContactCount=?, PValue=?, QValue=?, Caller=? WHERE ID=?",
+			interactionSignature(loci[it.ID]), it.SupportCount, it.ContactCount, it.PValue, it.QValue, it.Caller, it.ID)
+		if err != nil {
+			return merged, err
+		}
+	}
+
+	return merged, nil
+}
+
+func indexExists(name string) (exists bool, err error) {
+	err = db.Get(&exists, `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='index' AND name=?`, name)
+	return
+}
+
+func init() {
+	registerMigration(addColumnMigration("Interactions", "Signature", "text"))
+	registerMigration(addColumnMigration("Interactions", "SupportCount", "int NOT NULL DEFAULT 1"))
+	// The attributes of the loop caller are added before merging, which keeps them.
+	registerMigration(addColumnMigration("Interactions", "ContactCount", "int"))
+	registerMigration(addColumnMigration("Interactions", "PValue", "real"))
+	registerMigration(addColumnMigration("Interactions", "QValue", "real"))
+	registerMigration(addColumnMigration("Interactions", "Caller", "varchar(255)"))
+	registerMigration(Migration{
+		name: "merge duplicate Interactions",
+		needed: func() (bool, error) {
+			exists, err := indexExists("InteractionsSignatureIndex")
+			return !exists, err
+		},
+		apply: func(tx *sqlx.Tx) error {
+			merged, err := MergeDuplicateInteractions(tx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("[Info] Merged %d duplicate Interactions.\n", merged)
+			_, err = tx.Exec("CREATE UNIQUE INDEX InteractionsSignatureIndex ON Interactions (CellType, Signature)")
+			return err
+		},
+	})
+
+	// Merging again is only needed after signatures were changed outside of the backend.
+	registerCommand(Command{"RUN_INTERACTION_MERGE", func() {
+		err := RunMigrations()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			log.Fatal(err)
+		}
+		merged, err := MergeDuplicateInteractions(tx)
+		if err != nil {
+			tx.Rollback()
+			log.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("[Info] Merged %d duplicate Interactions.\n", merged)
+	}})
+}
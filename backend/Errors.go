@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+/**
+Errors
+The data layer reports failures with one of these kinds, so handlers never
+have to inspect messages. writeError maps them to RFC 7807 problem responses.
+**/
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrValidation  = errors.New("validation failed")
+	ErrForeignKey  = errors.New("foreign key violation")
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// An error of one of the kinds above, with a detail message fit for clients.
+type DataError struct {
+	Kind   error
+	Detail string
+}
+
+func (e DataError) Error() string {
+	return e.Detail
+}
+
+func (e DataError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// The error of one item of a bulk request, by its index in the request.
+type ItemError struct {
+	Index  int    `json:"index"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// Returned by bulk operations which were rolled back because some items failed.
+type BulkError struct {
+	Items []ItemError
+}
+
+func (e BulkError) Error() string {
+	return fmt.Sprintf("%d items could not be created", len(e.Items))
+}
+
+func notFound(noun string) error {
+	return DataError{ErrNotFound, fmt.Sprintf("Could not find %s.", noun)}
+}
+
+func invalid(format string, args ...interface{}) error {
+	return DataError{ErrValidation, fmt.Sprintf(format, args...)}
+}
+
+// Converts SQLite constraint violations into the matching kind of DataError.
+func dbError(err error) error {
+	var sqliteErr sqlite3.Error
+	if err == nil || !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintRowID:
+		return DataError{ErrConflict, sqliteErr.Error()}
+	case sqlite3.ErrConstraintForeignKey:
+		return DataError{ErrForeignKey, "The change references a missing item, or is referenced by another item. " + sqliteErr.Error()}
+	case sqlite3.ErrConstraintCheck, sqlite3.ErrConstraintNotNull:
+		return DataError{ErrValidation, sqliteErr.Error()}
+	}
+	return err
+}
+
+/** HTTP **/
+
+// An RFC 7807 problem details body.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+	// Every failed item of a bulk request, when that is what failed.
+	Errors []ItemError `json:"errors,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	encodeProblem(w, Problem{Status: status, Code: code, Detail: detail})
+}
+
+func encodeProblem(w http.ResponseWriter, p Problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// For request bodies or parameters which could not be read at all.
+func writeBadRequest(w http.ResponseWriter, detail string) {
+	writeProblem(w, http.StatusBadRequest, "bad_request", detail)
+}
+
+// The status and code of a problem caused by err, or ok false if it is of no known kind.
+func problemKind(err error) (status int, code string, ok bool) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "not_found", true
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, "conflict", true
+	case errors.Is(err, ErrForeignKey):
+		return http.StatusConflict, "foreign_key", true
+	case errors.Is(err, ErrValidation):
+		return http.StatusUnprocessableEntity, "validation", true
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, "unavailable", true
+	}
+	return http.StatusInternalServerError, "internal_error", false
+}
+
+// Describes the failure of one item of a bulk request.
+func itemError(index int, err error) ItemError {
+	err = dbError(err)
+	_, code, _ := problemKind(err)
+	return ItemError{index, code, err.Error()}
+}
+
+/*
+Writes the problem matching the kind of err, using its own detail. Errors of
+no known kind are logged and reported as a 500 with the given detail.
+*/
+func writeError(w http.ResponseWriter, err error, detail string) {
+	err = dbError(err)
+
+	var bulk BulkError
+	if errors.As(err, &bulk) {
+		encodeProblem(w, Problem{Status: http.StatusUnprocessableEntity, Code: "invalid_items", Detail: err.Error(), Errors: bulk.Items})
+		return
+	}
+
+	status, code, ok := problemKind(err)
+	if !ok {
+		fmt.Println(err.Error())
+		writeProblem(w, status, code, detail)
+		return
+	}
+
+	writeProblem(w, status, code, err.Error())
+}
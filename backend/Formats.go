@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+Content negotiation
+Lists are JSON unless another format is asked for, either with the format query
+parameter or the Accept header. The tabular formats are only available for
+entities implementing tabular:
+  bed    Loci as BED4 (chr, start, end, ID), Motif Instances as BED6 (chr,
+         start, end, model, score, strand), the score being the ThresholdScore
+         scaled to an integer from 0 to 1000.
+  bedpe  Interactions as BEDPE (chr1, start1, end1, chr2, start2, end2, ID,
+         score, strand1, strand2), the score being the SupportCount.
+         Interactions with more than two anchors are written as one line per
+         pair of anchors, all sharing the same ID.
+  tsv    Tab separated values with a header line. Interactions are written one
+         per line as ID, CellType, AnchorCount, Anchors (the comma separated
+         IDs of every anchor locus), then their SupportCount and attributes,
+         which are left empty when null.
+Sequences of the genome are JSON or FASTA (see Sequence.go).
+**/
+
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatBED    = "bed"
+	formatBEDPE  = "bedpe"
+	formatTSV    = "tsv"
+	formatFASTA  = "fasta"
+)
+
+var formatMediaTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatBED:    "text/x-bed",
+	formatBEDPE:  "text/x-bedpe",
+	formatTSV:    "text/tab-separated-values",
+	formatFASTA:  "text/x-fasta",
+}
+
+// Entities which can be written as one or more tab separated lines.
+type tabular interface {
+	// Formats the entity can be written in, other than JSON and NDJSON.
+	Formats() []string
+	// The header line of a format, or nil if it has none.
+	Header(format string) []string
+	// The lines representing the entity in a format.
+	Rows(format string) ([][]string, error)
+}
+
+/*
+Picks the format of a response. The format query parameter wins over Accept.
+Unknown formats are returned as is, so the caller can reject them.
+*/
+func negotiateFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		for format, known := range formatMediaTypes {
+			if mediaType == known {
+				return format
+			}
+		}
+	}
+
+	return formatJSON
+}
+
+func supportsFormat(t tabular, format string) bool {
+	for _, f := range t.Formats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams a list in one of the tabular formats, or 406 if its entity does not support it.
+func serveTabularList[T any](w http.ResponseWriter, spec ListSpec, p ListParams, noun string, format string, base string, baseArgs ...interface{}) {
+	var zero T
+	t, ok := any(zero).(tabular)
+	if !ok || !supportsFormat(t, format) {
+		writeProblem(w, http.StatusNotAcceptable, "not_acceptable", fmt.Sprintf("%s cannot be returned as %s.", noun, format))
+		return
+	}
+
+	prefix := ""
+	if header := t.Header(format); header != nil {
+		prefix = strings.Join(header, "\t") + "\n"
+	}
+
+	streamList(w, spec, p, noun, formatMediaTypes[format], prefix, func(item T) error {
+		rows, err := any(item).(tabular).Rows(format)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			_, err = fmt.Fprintln(w, strings.Join(row, "\t"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, base, baseArgs...)
+}
+
+// Optional values are written as empty fields when they are null.
+func optionalInt(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+func optionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+func optionalString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func strandOf(forward bool) string {
+	if forward {
+		return "+"
+	}
+	return "-"
+}
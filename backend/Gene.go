@@ -1,9 +1,7 @@
-// TODO: Implement automatic relationship between Genes and Loci on creation/edit of Genes.
 package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,29 +9,129 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Genes on the "-" strand are transcribed from End towards Start.
 type Gene struct {
-	Name  string `json:"Name" db:"Name"`
-	Chr   string `json:"Chr" db:"Chr"`
-	Start int    `json:"Start" db:"Start"`
-	End   int    `json:"End" db:"End"`
+	Name   string `json:"Name" db:"Name"`
+	Chr    string `json:"Chr" db:"Chr"`
+	Start  int    `json:"Start" db:"Start"`
+	End    int    `json:"End" db:"End"`
+	Strand string `json:"Strand" db:"Strand"`
+	Bin    int    `json:"-" db:"Bin"`
+}
+
+var geneList = ListSpec{
+	Fields: map[string]ListField{
+		"name":   {"Name", fieldString},
+		"chr":    {"Chr", fieldChr},
+		"start":  {"Start", fieldInt},
+		"end":    {"End", fieldInt},
+		"strand": {"Strand", fieldString},
+	},
+	Order: "Name",
+}
+
+/*
+Puts the chromosome in canonical form, and checks the gene fits on it. Genes
+without a strand are taken to be on the "+" strand.
+*/
+func (g Gene) Normalize() (Gene, error) {
+	r, err := NewRegion(g.Chr, g.Start, g.End)
+	if err != nil {
+		return g, err
+	}
+	g.Chr = r.Chr
+
+	if g.Strand == "" {
+		g.Strand = "+"
+	}
+	if g.Strand != "+" && g.Strand != "-" {
+		return g, invalid("Strand of Gene %s must be + or -.", g.Name)
+	}
+	return g, nil
 }
 
 func (g Gene) Create() (err error) {
-	query := `INSERT INTO Genes VALUES (?, ?, ?, ?)`
-	_, err = db.Exec(query, g.Name, g.Chr, g.Start, g.End)
-	return
+	// Genes of loci are part of the graphs of cell types.
+	defer invalidateGraphs()
+
+	g, err = g.Normalize()
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO Genes (Name, Chr, Start, End, Strand, Bin) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, g.Name, g.Chr, g.Start, g.End, g.Strand, binFromRange(g.Start, g.End))
+	if err != nil {
+		return
+	}
+
+	err = linkGeneToLoci(tx, g)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
 }
 
 func (g Gene) Save(oldName string) (err error) {
-	query := `UPDATE Genes SET Name = ?, Chr = ?, Start = ?, End = ? WHERE Name = ?`
-	_, err = db.Exec(query, g.Name, g.Chr, g.Start, g.End, oldName)
-	return
+	defer invalidateGraphs()
+
+	g, err = g.Normalize()
+	if err != nil {
+		return
+	}
+
+	// Relations of the old name are dropped, and rebuilt for the new coordinates,
+	// all or nothing so a failed update keeps them.
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM GeneInLocus WHERE Gene = ?`, oldName)
+	if err != nil {
+		return
+	}
+
+	query := `UPDATE Genes SET Name = ?, Chr = ?, Start = ?, End = ?, Strand = ?, Bin = ? WHERE Name = ?`
+	_, err = tx.Exec(query, g.Name, g.Chr, g.Start, g.End, g.Strand, binFromRange(g.Start, g.End), oldName)
+	if err != nil {
+		return
+	}
+
+	err = linkGeneToLoci(tx, g)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
 }
 
 func (g Gene) Delete() (err error) {
+	defer invalidateGraphs()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM GeneInLocus WHERE Gene = ?`, g.Name)
+	if err != nil {
+		return
+	}
+
 	query := `DELETE FROM Genes WHERE Name = ?`
-	_, err = db.Exec(query, g.Name)
-	return
+	_, err = tx.Exec(query, g.Name)
+	if err != nil {
+		return dbError(err)
+	}
+	return tx.Commit()
 }
 
 func GetGene(name string) (gene Gene, err error) {
@@ -50,7 +148,7 @@ func GetGene(name string) (gene Gene, err error) {
 		return g, nil
 	}
 	// Not found.
-	return Gene{}, errors.New("not_found")
+	return Gene{}, notFound("Gene")
 }
 
 func GetGenes() (genes []Gene, err error) {
@@ -76,32 +174,62 @@ func handleCreateGenes(w http.ResponseWriter, r *http.Request) {
 	result := make([]Gene, 0)
 	err := json.NewDecoder(r.Body).Decode(&result)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body must be an array of Genes")
+		writeBadRequest(w, "Request body must be an array of Genes")
 		return
 	}
 
+	for i := 0; i < len(result); i++ {
+		result[i], err = result[i].Normalize()
+		if err != nil {
+			writeBadRequest(w, fmt.Sprintf("Invalid Gene at index %d: %s", i, err.Error()))
+			return
+		}
+	}
+
 	values := make([]string, len(result))
-	args := make([]interface{}, (len(result) * 4))
+	args := make([]interface{}, (len(result) * 6))
 	point := 0
 	for i := 0; i < len(result); i++ {
-		values[i] = "(?, ?, ?, ?)"
+		values[i] = "(?, ?, ?, ?, ?, ?)"
 		args[point] = result[i].Name
 		args[point+1] = result[i].Chr
 		args[point+2] = result[i].Start
 		args[point+3] = result[i].End
-		point += 4
+		args[point+4] = result[i].Strand
+		args[point+5] = binFromRange(result[i].Start, result[i].End)
+		point += 6
+	}
+
+	// The genes and their links to loci are created all or nothing.
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, err, "Could not create new Genes.")
+		return
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("INSERT INTO Genes (Name, Chr, Start, End, Strand, Bin) VALUES %s", strings.Join(values, ", "))
+	_, err = tx.Exec(query, args...)
+
+	if err != nil {
+		writeError(w, err, "Could not create new Genes.")
+		return
 	}
 
-	query := fmt.Sprintf("INSERT INTO Genes VALUES %s", strings.Join(values, ", "))
-	_, err = db.Exec(query, args...)
+	for _, g := range result {
+		err = linkGeneToLoci(tx, g)
+		if err != nil {
+			writeError(w, err, "Could not link the new Genes to Loci.")
+			return
+		}
+	}
 
+	err = tx.Commit()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Println(err.Error())
-		fmt.Fprint(w, "Could not create new Genes.\n", err.Error())
+		writeError(w, err, "Could not create new Genes.")
 		return
 	}
+	invalidateGraphs()
 
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "Created new Genes.")
@@ -111,20 +239,13 @@ func handleGetGene(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	gene, err := GetGene(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Gene.")
-		}
+		writeError(w, err, "Could not fetch Gene.")
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(gene)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Gene.")
+		writeError(w, err, "Could not fetch Gene.")
 	}
 }
 
@@ -132,28 +253,20 @@ func handleEditGene(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	gene, err := GetGene(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Gene.")
-		}
+		writeError(w, err, "Could not fetch Gene.")
 		return
 	}
 
 	var newGene Gene
 	err = json.NewDecoder(r.Body).Decode(&newGene)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body must be a Gene.")
+		writeBadRequest(w, "Request body must be a Gene.")
 		return
 	}
 
 	err = newGene.Save(gene.Name)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not save Gene.")
+		writeError(w, err, "Could not save Gene.")
 	}
 }
 
@@ -161,21 +274,14 @@ func handleDeleteGene(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	gene, err := GetGene(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Genes.")
-		}
+		writeError(w, err, "Could not fetch Genes.")
 		return
 	}
 
 	err = gene.Delete()
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Gene.")
+		writeError(w, err, "Could not delete Gene.")
 	}
 }
 
@@ -183,48 +289,45 @@ func handleGetGeneLoci(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	gene, err := GetGene(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Gene.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Genes.")
-		}
+		writeError(w, err, "Could not fetch Genes.")
 		return
 	}
 
-	loci, err := gene.GetLoci()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Loci of Gene.")
-		return
-	}
-
-	json.NewEncoder(w).Encode(loci)
+	serveList[Locus](w, r, locusList, "Loci of Gene", geneLociQuery, gene.Name)
 }
 
-// Temporary functions to manually create the relations.
+// Manual overrides of the relations. Any later edit of the Gene or Locus recomputes them.
 func handleCreateGeneLociRelation(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	// SQL will automatically fail if the Gene and Locus are dupes, or don't exist.
+	// A missing Gene is a 404, while a missing Locus or an existing relationship
+	// fail in SQL as a foreign key violation or a conflict.
 	var locusID string
 
 	err := json.NewDecoder(r.Body).Decode(&locusID)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body should be a string referring to the ID of a Locus")
+		writeBadRequest(w, "Request body should be a string referring to the ID of a Locus")
+		return
+	}
+	locusID, ok := parseLocusID(w, locusID)
+	if !ok {
+		return
+	}
+
+	gene, err := GetGene(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Genes.")
 		return
 	}
 
 	query := `INSERT INTO GeneInLocus VALUES (?, ?)`
-	_, err = db.Exec(query, locusID, v["name"])
+	_, err = db.Exec(query, locusID, gene.Name)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid request. Either the Locus or Gene does not exist, or this relationship already exists.")
+		writeError(w, dbError(err), "Could not create relationship.")
 		return
 	}
+	invalidateGraphs()
 
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, "Created relationship.")
@@ -237,8 +340,11 @@ func handleDeleteGeneLociRelation(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&locusID)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body should be a string referring to the ID of a Locus.")
+		writeBadRequest(w, "Request body should be a string referring to the ID of a Locus.")
+		return
+	}
+	locusID, ok := parseLocusID(w, locusID)
+	if !ok {
 		return
 	}
 
@@ -246,22 +352,31 @@ func handleDeleteGeneLociRelation(w http.ResponseWriter, r *http.Request) {
 	_, err = db.Exec(query, locusID, v["name"])
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete relationship.")
+		writeError(w, err, "Could not delete relationship.")
 		return
 	}
+	invalidateGraphs()
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Deleted relationship.")
 }
 
 func init() {
-	registerRoute(Route{"/genes", handleGetGeneric(GetGenes), "GET"})
-	registerRoute(Route{"/genes", handleCreateGenes, "POST"})
-	registerRoute(Route{"/genes/{name}", handleGetGene, "GET"})
-	registerRoute(Route{"/genes/{name}", handleEditGene, "PUT"})
-	registerRoute(Route{"/genes/{name}", handleDeleteGene, "DELETE"})
-	registerRoute(Route{"/genes/{name}/loci", handleGetGeneLoci, "GET"})
-	registerRoute(Route{"/genes/{name}/loci", handleCreateGeneLociRelation, "POST"})
-	registerRoute(Route{"/genes/{name}/loci", handleDeleteGeneLociRelation, "DELETE"})
+	registerMigration(addColumnMigration("Genes", "Strand", "char(1) NOT NULL DEFAULT '+'"))
+	registerRoute(Route{path: "/genes", handler: handleListGeneric[Gene](geneList, "Genes", "SELECT * FROM Genes"), method: "GET",
+		summary: "List genes", response: []Gene{}, list: &geneList})
+	registerRoute(Route{path: "/genes", handler: handleCreateGenes, method: "POST",
+		summary: "Create genes", body: []Gene{}})
+	registerRoute(Route{path: "/genes/{name}", handler: handleGetGene, method: "GET",
+		summary: "Get a gene", response: Gene{}})
+	registerRoute(Route{path: "/genes/{name}", handler: handleEditGene, method: "PUT",
+		summary: "Edit a gene", body: Gene{}})
+	registerRoute(Route{path: "/genes/{name}", handler: handleDeleteGene, method: "DELETE",
+		summary: "Delete a gene"})
+	registerRoute(Route{path: "/genes/{name}/loci", handler: handleGetGeneLoci, method: "GET",
+		summary: "List the loci overlapping a gene", response: []Locus{}, list: &locusList})
+	registerRoute(Route{path: "/genes/{name}/loci", handler: handleCreateGeneLociRelation, method: "POST",
+		summary: "Relate a locus to a gene, given its ID", body: ""})
+	registerRoute(Route{path: "/genes/{name}/loci", handler: handleDeleteGeneLociRelation, method: "DELETE",
+		summary: "Remove the relation of a locus to a gene, given its ID", body: ""})
 }
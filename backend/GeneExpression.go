@@ -1,13 +1,20 @@
 package main
 
-import "errors"
-
 type GeneExpression struct {
 	CellType        string  `json:"CellType" db:"CellType"`
 	Gene            string  `json:"Gene" db:"Gene"`
 	ExpressionLevel float64 `json:"ExpressionLevel" db:"ExpressionLevel"`
 }
 
+var geneExpressionList = ListSpec{
+	Fields: map[string]ListField{
+		"celltype":   {"CellType", fieldString},
+		"gene":       {"Gene", fieldString},
+		"expression": {"ExpressionLevel", fieldFloat},
+	},
+	Order: "CellType, Gene",
+}
+
 func (c CellType) GeneExpressions() ([]GeneExpression, error) {
 	query := `SELECT * FROM GeneExpression WHERE CellType=?`
 	results, err := db.Queryx(query, c.Type)
@@ -40,7 +47,7 @@ func (c CellType) GeneExpression(name string) (GeneExpression, error) {
 		return exp, nil
 	}
 
-	return GeneExpression{}, errors.New("not_found")
+	return GeneExpression{}, notFound("Gene Expression")
 }
 
 func (g Gene) GeneExpressions() ([]GeneExpression, error) {
@@ -64,17 +71,17 @@ func (g Gene) GeneExpressions() ([]GeneExpression, error) {
 func (g GeneExpression) Create() (err error) {
 	query := `INSERT INTO GeneExpression VALUES (?, ?, ?)`
 	_, err = db.Exec(query, g.CellType, g.Gene, g.ExpressionLevel)
-	return
+	return dbError(err)
 }
 
 func (g GeneExpression) Save() (err error) {
 	query := `UPDATE GeneExpression SET ExpressionLevel=? WHERE CellType=? AND Gene=?`
 	_, err = db.Exec(query, g.ExpressionLevel, g.CellType, g.Gene)
-	return
+	return dbError(err)
 }
 
 func (g GeneExpression) Delete() (err error) {
 	query := `DELETE FROM GeneExpression WHERE CellType=? AND Gene=?`
 	_, err = db.Exec(query, g.CellType, g.Gene)
-	return
+	return dbError(err)
 }
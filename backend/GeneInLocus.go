@@ -1,13 +1,22 @@
 package main
 
+import (
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
 type GeneInLocus struct {
 	Locus string `json:"Locus" db:"Locus"`
 	Gene  string `json:"Gene" db:"Gene"`
 }
 
+const geneLociQuery = `SELECT L.* FROM Loci AS L INNER JOIN GeneInLocus AS G ON L.ID=G.Locus WHERE G.Gene=?`
+const locusGenesQuery = `SELECT G.* FROM Genes AS G INNER JOIN GeneInLocus AS GIL ON G.Name=GIL.Gene WHERE GIL.Locus=?`
+
 func (g Gene) GetLoci() (result []Locus, err error) {
-	query := `SELECT L.* FROM Loci AS L INNER JOIN GeneInLocus AS G ON L.ID=G.Locus WHERE G.Gene=?`
-	rows, err := db.Queryx(query, g.Name)
+	rows, err := db.Queryx(geneLociQuery, g.Name)
 	if err != nil {
 		return []Locus{}, err
 	}
@@ -27,8 +36,7 @@ func (g Gene) GetLoci() (result []Locus, err error) {
 }
 
 func (l Locus) GetGenes() (result []Gene, err error) {
-	query := `SELECT G.* FROM Genes AS G INNER JOIN GeneInLocus AS GIL ON G.Name=GIL.Gene WHERE GIL.Locus=?`
-	rows, err := db.Queryx(query, l.ID)
+	rows, err := db.Queryx(locusGenesQuery, l.ID)
 	if err != nil {
 		return []Gene{}, err
 	}
@@ -46,3 +54,81 @@ func (l Locus) GetGenes() (result []Gene, err error) {
 
 	return
 }
+
+/**
+Automatic maintenance of GeneInLocus.
+A gene is in a locus whenever their intervals overlap on the same chromosome.
+The helpers take an Execer so they can run inside of a transaction.
+**/
+
+// Replaces the loci of a gene with every locus it currently overlaps.
+func linkGeneToLoci(ex sqlx.Execer, g Gene) (err error) {
+	_, err = ex.Exec(`DELETE FROM GeneInLocus WHERE Gene=?`, g.Name)
+	if err != nil {
+		return
+	}
+
+	clause, args := overlapClause("", "End", g.Chr, g.Start, g.End)
+	query := `INSERT INTO GeneInLocus (Locus, Gene) SELECT ID, ? FROM Loci WHERE ` + clause
+	_, err = ex.Exec(query, append([]interface{}{g.Name}, args...)...)
+	return dbError(err)
+}
+
+// Replaces the genes of a locus with every gene it currently overlaps.
+func linkLocusToGenes(ex sqlx.Execer, l Locus) (err error) {
+	_, err = ex.Exec(`DELETE FROM GeneInLocus WHERE Locus=?`, l.ID)
+	if err != nil {
+		return
+	}
+
+	clause, args := overlapClause("", "End", l.Chr, l.Start, l.End)
+	query := `INSERT INTO GeneInLocus (Locus, Gene) SELECT ?, Name FROM Genes WHERE ` + clause
+	_, err = ex.Exec(query, append([]interface{}{l.ID}, args...)...)
+	return dbError(err)
+}
+
+/*
+Recomputes GeneInLocus from scratch, for databases loaded before the relation
+was maintained automatically.
+*/
+func RebuildGeneInLocus() error {
+	genes, err := GetGenes()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM GeneInLocus`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, g := range genes {
+		err = linkGeneToLoci(tx, g)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[Info] Linked %d genes to their loci.\n", len(genes))
+	return nil
+}
+
+func init() {
+	registerCommand(Command{"RUN_GENE_LOCUS_REBUILD", func() {
+		err := RebuildGeneInLocus()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+Reference genome
+The sequence of the genome is read from the FASTA file at GENOME_FASTA, by
+random access through its samtools .fai index, so the genome is never held in
+memory. When the file has no index one is built by reading it once, which
+needs every sequence to be wrapped at a fixed line length. Sequence names are
+normalized like any chromosome, so "X" in the FASTA is chrX of the database.
+**/
+
+// A sequence of the FASTA, as described by a line of its .fai index.
+type faiEntry struct {
+	Name   string
+	Length int
+	// Byte offset of the first base.
+	Offset int64
+	// Bases per line, and bytes per line including the line break.
+	LineBases int
+	LineWidth int
+}
+
+type Genome struct {
+	file *os.File
+	// Entries by normalized chromosome name.
+	entries map[string]faiEntry
+}
+
+// Opens a FASTA file, reading its .fai index or building one if it has none.
+func OpenGenome(path string) (*Genome, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []faiEntry
+	index, err := os.Open(path + ".fai")
+	switch {
+	case err == nil:
+		entries, err = readFai(index)
+		index.Close()
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Printf("[Info] %s has no .fai index, indexing it.\n", path)
+		entries, err = indexFasta(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	g := &Genome{file: file, entries: make(map[string]faiEntry)}
+	for _, e := range entries {
+		g.entries[normalizeChrName(e.Name)] = e
+	}
+	return g, nil
+}
+
+func readFai(r io.Reader) ([]faiEntry, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.Comma = '\t'
+	csvReader.FieldsPerRecord = -1
+
+	entries := make([]faiEntry, 0)
+	for {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 5 {
+			return nil, fmt.Errorf("index line of %s has %d fields instead of 5", rec[0], len(rec))
+		}
+
+		var numbers [4]int64
+		for i, field := range rec[1:5] {
+			numbers[i], err = strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("index line of %s: %w", rec[0], err)
+			}
+		}
+		e := faiEntry{Name: rec[0], Length: int(numbers[0]), Offset: numbers[1], LineBases: int(numbers[2]), LineWidth: int(numbers[3])}
+		if e.LineBases < 1 || e.LineWidth < e.LineBases {
+			return nil, fmt.Errorf("index line of %s has invalid line lengths", rec[0])
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Builds the index of a FASTA file, as samtools faidx would.
+func indexFasta(file *os.File) ([]faiEntry, error) {
+	entries := make([]faiEntry, 0)
+	reader := bufio.NewReader(file)
+	var offset int64
+	var current *faiEntry
+	// Whether a line shorter than the others was read, which must be the last of its sequence.
+	shortLine := false
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		start := offset
+		offset += int64(len(line))
+
+		if line[0] == '>' {
+			name := strings.Fields(string(line[1:]))
+			if len(name) == 0 {
+				return nil, fmt.Errorf("sequence %d has no name", len(entries)+1)
+			}
+			entries = append(entries, faiEntry{Name: name[0], Offset: offset})
+			current = &entries[len(entries)-1]
+			shortLine = false
+			continue
+		}
+		if current == nil {
+			return nil, errors.New("the file does not start with a > header line")
+		}
+
+		bases := len(bytes.TrimRight(line, "\r\n"))
+		if bases == 0 {
+			continue
+		}
+		if current.LineBases == 0 {
+			current.Offset = start
+			current.LineBases = bases
+			current.LineWidth = len(line)
+		} else if shortLine || bases > current.LineBases {
+			return nil, fmt.Errorf("the lines of %s are not all of the same length, index it with samtools faidx", current.Name)
+		}
+		shortLine = bases < current.LineBases
+		current.Length += bases
+	}
+	return entries, nil
+}
+
+// Whether the genome has the sequence of a chromosome.
+func (g *Genome) Has(chr string) bool {
+	_, ok := g.entries[chr]
+	return ok
+}
+
+/*
+Reads the bases from start to end (half-open, 0-based) of a normalized
+chromosome, in upper case.
+*/
+func (g *Genome) Sequence(chr string, start int, end int) ([]byte, error) {
+	region := Region{Chr: chr, Start: start, End: end}
+	e, ok := g.entries[chr]
+	if !ok {
+		return nil, RegionError{region.String(), fmt.Sprintf("chromosome %s is not in the genome FASTA", chr)}
+	}
+	if start < 0 || end < start || end > e.Length {
+		return nil, RegionError{region.String(), fmt.Sprintf("outside of %s in the genome FASTA (%d)", chr, e.Length)}
+	}
+	if start == end {
+		return []byte{}, nil
+	}
+
+	// Offsets of the first and past the last base, skipping the line breaks before them.
+	offsetOf := func(pos int) int64 {
+		return e.Offset + int64(pos/e.LineBases)*int64(e.LineWidth) + int64(pos%e.LineBases)
+	}
+	from := offsetOf(start)
+	raw := make([]byte, offsetOf(end-1)+1-from)
+	_, err := g.file.ReadAt(raw, from)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := make([]byte, 0, end-start)
+	for _, b := range raw {
+		if b != '\n' && b != '\r' {
+			seq = append(seq, b)
+		}
+	}
+	if len(seq) != end-start {
+		return nil, fmt.Errorf("read %d bases of %s instead of %d, the .fai index may be stale", len(seq), region.String(), end-start)
+	}
+	return bytes.ToUpper(seq), nil
+}
+
+var (
+	genomeMutex  sync.Mutex
+	loadedGenome *Genome
+)
+
+/*
+Returns the genome of GENOME_FASTA, opening it on first use. Fails with
+ErrUnavailable if no genome is configured.
+*/
+func GetGenome() (*Genome, error) {
+	genomeMutex.Lock()
+	defer genomeMutex.Unlock()
+
+	if loadedGenome != nil {
+		return loadedGenome, nil
+	}
+	path := os.Getenv("GENOME_FASTA")
+	if path == "" {
+		return nil, DataError{ErrUnavailable, "No genome FASTA is configured, set GENOME_FASTA."}
+	}
+	g, err := OpenGenome(path)
+	if err != nil {
+		return nil, err
+	}
+	loadedGenome = g
+	return g, nil
+}
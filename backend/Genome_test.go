@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chrX is wrapped at 4 bases, ending with a partial line, and chr2 is a single line.
+const testFasta = ">X description\nACGT\nacgt\nTTGG\nCA\n>2\nGATTACA\n"
+
+// The index samtools faidx writes for testFasta.
+const testFai = "X\t14\t15\t4\t5\n2\t7\t36\t7\t8\n"
+
+func openTestGenome(t *testing.T, fasta string, fai string) *Genome {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "genome.fa")
+	err := os.WriteFile(path, []byte(fasta), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fai != "" {
+		err = os.WriteFile(path+".fai", []byte(fai), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := OpenGenome(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.file.Close() })
+	return g
+}
+
+func TestGenomeSequence(t *testing.T) {
+	genomes := map[string]*Genome{
+		"built index":        openTestGenome(t, testFasta, ""),
+		"CRLF line breaks":   openTestGenome(t, strings.ReplaceAll(testFasta, "\n", "\r\n"), ""),
+		"samtools fai index": openTestGenome(t, testFasta, testFai),
+	}
+	tests := []struct {
+		name       string
+		chr        string
+		start, end int
+		want       string
+		wantErr    bool
+	}{
+		{"first line", "chrX", 0, 4, "ACGT", false},
+		{"within a line", "chrX", 1, 3, "CG", false},
+		{"lower case", "chrX", 4, 8, "ACGT", false},
+		{"across a line break", "chrX", 2, 6, "GTAC", false},
+		{"across two line breaks", "chrX", 3, 9, "TACGTT", false},
+		{"last partial line", "chrX", 12, 14, "CA", false},
+		{"to the end", "chrX", 10, 14, "GGCA", false},
+		{"whole chromosome", "chrX", 0, 14, "ACGTACGTTTGGCA", false},
+		{"empty", "chrX", 5, 5, "", false},
+		{"second chromosome", "chr2", 1, 5, "ATTA", false},
+		{"past the end", "chrX", 12, 15, "", true},
+		{"negative start", "chrX", -1, 2, "", true},
+		{"missing chromosome", "chr3", 0, 1, "", true},
+	}
+	for name, g := range genomes {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				seq, err := g.Sequence(tt.chr, tt.start, tt.end)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+				}
+				if tt.wantErr {
+					if !errors.Is(err, ErrValidation) {
+						t.Errorf("error %v is not a validation error", err)
+					}
+					return
+				}
+				if string(seq) != tt.want {
+					t.Errorf("Sequence(%s, %d, %d) = %q, want %q", tt.chr, tt.start, tt.end, seq, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestIndexFastaMatchesSamtools(t *testing.T) {
+	built := openTestGenome(t, testFasta, "")
+	want, err := readFai(strings.NewReader(testFai))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range want {
+		if got := built.entries[normalizeChrName(e.Name)]; got != e {
+			t.Errorf("index of %s = %+v, want %+v", e.Name, got, e)
+		}
+	}
+}
+
+func TestIndexFastaRejectsUnevenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "genome.fa")
+	err := os.WriteFile(path, []byte(">X\nACG\nACGT\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenGenome(path)
+	if err == nil {
+		t.Error("OpenGenome of lines longer than the first succeeded")
+	}
+}
+
+func TestReverseComplement(t *testing.T) {
+	tests := []struct{ seq, want string }{
+		{"", ""},
+		{"A", "T"},
+		{"ACGT", "ACGT"},
+		{"AACGTTTG", "CAAACGTT"},
+		{"ANNC", "GNNT"},
+		{"AXC", "GNT"},
+	}
+	for _, tt := range tests {
+		got := string(reverseComplement([]byte(tt.seq)))
+		if got != tt.want {
+			t.Errorf("reverseComplement(%q) = %q, want %q", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestMotifInstanceSequence(t *testing.T) {
+	g := openTestGenome(t, testFasta, "")
+	tests := []struct {
+		forward  bool
+		wantName string
+		wantSeq  string
+	}{
+		{true, "M::chrX:2-8(+)", "GTACGT"},
+		{false, "M::chrX:2-8(-)", "ACGTAC"},
+	}
+	for _, tt := range tests {
+		rec, err := g.MotifInstanceSequence(MotifInstance{Chr: "chrX", Start: 2, Length: 6, Forward: tt.forward, Model: "M"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Name != tt.wantName || rec.Sequence != tt.wantSeq || rec.End != 8 {
+			t.Errorf("forward %v: got %s %s ending at %d, want %s %s ending at 8", tt.forward, rec.Name, rec.Sequence, rec.End, tt.wantName, tt.wantSeq)
+		}
+	}
+}
+
+func TestWriteFASTA(t *testing.T) {
+	var out strings.Builder
+	seq := strings.Repeat("A", fastaLineWidth) + "CG"
+	err := writeFASTA(&out, SequenceRecord{Name: "chrX:0-62", Sequence: seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ">chrX:0-62\n" + strings.Repeat("A", fastaLineWidth) + "\nCG\n"
+	if out.String() != want {
+		t.Errorf("writeFASTA = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Graph analytics
+Within a cell type, loci are the nodes of a graph connected whenever they are
+anchors of the same interaction, as for neighbourhoods. The degree of a locus
+is its number of distinct neighbours, and its loci and genes are grouped into
+connected components. Analysing a cell type reads all of its interactions, so
+the result is kept in memory until the interactions of that cell type, or the
+genes of any locus, change.
+**/
+
+// Loci with at least this degree are hubs, unless a request asks otherwise.
+const defaultHubDegree = 5
+
+type LocusDegree struct {
+	Locus string `json:"Locus"`
+	// Number of distinct loci sharing an interaction with this one.
+	Degree int `json:"Degree"`
+	// Number of interactions this locus is an anchor of.
+	Interactions int `json:"Interactions"`
+	Component    int `json:"Component"`
+}
+
+// A connected component, numbered from 1 by decreasing size.
+type GraphComponent struct {
+	ID           int      `json:"ID"`
+	Size         int      `json:"Size"`
+	Interactions int      `json:"Interactions"`
+	Loci         []string `json:"Loci"`
+	Genes        []string `json:"Genes"`
+}
+
+type GraphSummary struct {
+	CellType         string  `json:"CellType"`
+	Loci             int     `json:"Loci"`
+	Edges            int     `json:"Edges"`
+	Interactions     int     `json:"Interactions"`
+	Components       int     `json:"Components"`
+	LargestComponent int     `json:"LargestComponent"`
+	MaxDegree        int     `json:"MaxDegree"`
+	MeanDegree       float64 `json:"MeanDegree"`
+}
+
+// The analysed graph of one cell type. Degrees are sorted by decreasing degree.
+type CellGraph struct {
+	Summary    GraphSummary
+	Degrees    []LocusDegree
+	Components []GraphComponent
+}
+
+/*
+Analysed graphs by cell type. Every invalidation bumps the generation, and a
+graph is only stored if no invalidation happened while it was being analysed,
+so a stale graph is never kept.
+*/
+type graphCache struct {
+	sync.Mutex
+	generation int
+	graphs     map[string]*CellGraph
+}
+
+var cellGraphs = &graphCache{graphs: make(map[string]*CellGraph)}
+
+// Drops the graph of a cell type, after its interactions changed.
+func invalidateGraph(celltype string) {
+	cellGraphs.Lock()
+	defer cellGraphs.Unlock()
+	cellGraphs.generation++
+	delete(cellGraphs.graphs, celltype)
+}
+
+// Drops the graphs of every cell type, after the genes of some locus changed.
+func invalidateGraphs() {
+	cellGraphs.Lock()
+	defer cellGraphs.Unlock()
+	cellGraphs.generation++
+	cellGraphs.graphs = make(map[string]*CellGraph)
+}
+
+// Returns the analysed graph of a cell type, from the cache when possible.
+func GetCellGraph(celltype string) (*CellGraph, error) {
+	cellGraphs.Lock()
+	g, ok := cellGraphs.graphs[celltype]
+	generation := cellGraphs.generation
+	cellGraphs.Unlock()
+	if ok {
+		return g, nil
+	}
+
+	g, err := analyzeCellGraph(celltype)
+	if err != nil {
+		return nil, err
+	}
+
+	cellGraphs.Lock()
+	if cellGraphs.generation == generation {
+		cellGraphs.graphs[celltype] = g
+	}
+	cellGraphs.Unlock()
+	return g, nil
+}
+
+// Finds the root of a locus in a union-find forest, compressing the path.
+func findRoot(parent map[string]string, id string) string {
+	for parent[id] != id {
+		parent[id] = parent[parent[id]]
+		id = parent[id]
+	}
+	return id
+}
+
+func analyzeCellGraph(celltype string) (*CellGraph, error) {
+	rows, err := db.Queryx(`SELECT P.Interaction, P.Locus FROM InteractionParticipation AS P
+		INNER JOIN Interactions AS I ON I.ID=P.Interaction
+		WHERE I.CellType=? ORDER BY P.Interaction, P.Locus`, celltype)
+	if err != nil {
+		return nil, err
+	}
+	anchors := make(map[int64][]string)
+	order := make([]int64, 0)
+	for rows.Next() {
+		var p struct {
+			Interaction int64  `db:"Interaction"`
+			Locus       string `db:"Locus"`
+		}
+		err = rows.StructScan(&p)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, seen := anchors[p.Interaction]; !seen {
+			order = append(order, p.Interaction)
+		}
+		anchors[p.Interaction] = append(anchors[p.Interaction], p.Locus)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	neighbours := make(map[string]map[string]bool)
+	interactions := make(map[string]int)
+	parent := make(map[string]string)
+	for _, id := range order {
+		loci := anchors[id]
+		for _, l := range loci {
+			if _, seen := parent[l]; !seen {
+				parent[l] = l
+				neighbours[l] = make(map[string]bool)
+			}
+			interactions[l]++
+		}
+		for i, a := range loci {
+			for _, b := range loci[i+1:] {
+				neighbours[a][b] = true
+				neighbours[b][a] = true
+			}
+			parent[findRoot(parent, a)] = findRoot(parent, loci[0])
+		}
+	}
+
+	members := make(map[string][]string)
+	for l := range parent {
+		root := findRoot(parent, l)
+		members[root] = append(members[root], l)
+	}
+	componentInteractions := make(map[string]int)
+	for _, id := range order {
+		componentInteractions[findRoot(parent, anchors[id][0])]++
+	}
+
+	roots := make([]string, 0, len(members))
+	for root, loci := range members {
+		sort.Strings(loci)
+		roots = append(roots, root)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		a, b := members[roots[i]], members[roots[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a[0] < b[0]
+	})
+
+	genes, err := cellTypeLocusGenes(celltype)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &CellGraph{
+		Summary:    GraphSummary{CellType: celltype, Loci: len(parent), Interactions: len(order), Components: len(roots)},
+		Degrees:    make([]LocusDegree, 0, len(parent)),
+		Components: make([]GraphComponent, len(roots)),
+	}
+	componentOf := make(map[string]int, len(roots))
+	for i, root := range roots {
+		componentOf[root] = i + 1
+		c := GraphComponent{ID: i + 1, Size: len(members[root]), Interactions: componentInteractions[root], Loci: members[root], Genes: make([]string, 0)}
+		seen := make(map[string]bool)
+		for _, l := range c.Loci {
+			for _, gene := range genes[l] {
+				if !seen[gene] {
+					seen[gene] = true
+					c.Genes = append(c.Genes, gene)
+				}
+			}
+		}
+		sort.Strings(c.Genes)
+		g.Components[i] = c
+	}
+	if len(roots) > 0 {
+		g.Summary.LargestComponent = g.Components[0].Size
+	}
+
+	totalDegree := 0
+	for l := range parent {
+		d := LocusDegree{Locus: l, Degree: len(neighbours[l]), Interactions: interactions[l], Component: componentOf[findRoot(parent, l)]}
+		totalDegree += d.Degree
+		if d.Degree > g.Summary.MaxDegree {
+			g.Summary.MaxDegree = d.Degree
+		}
+		g.Degrees = append(g.Degrees, d)
+	}
+	sort.Slice(g.Degrees, func(i, j int) bool {
+		if g.Degrees[i].Degree != g.Degrees[j].Degree {
+			return g.Degrees[i].Degree > g.Degrees[j].Degree
+		}
+		return g.Degrees[i].Locus < g.Degrees[j].Locus
+	})
+	g.Summary.Edges = totalDegree / 2
+	if len(parent) > 0 {
+		g.Summary.MeanDegree = float64(totalDegree) / float64(len(parent))
+	}
+
+	return g, nil
+}
+
+// Returns the genes of every locus which is an anchor in the cell type.
+func cellTypeLocusGenes(celltype string) (map[string][]string, error) {
+	rows, err := db.Queryx(`SELECT DISTINCT G.Locus, G.Gene FROM GeneInLocus AS G
+		INNER JOIN InteractionParticipation AS P ON P.Locus=G.Locus
+		INNER JOIN Interactions AS I ON I.ID=P.Interaction
+		WHERE I.CellType=?`, celltype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genes := make(map[string][]string)
+	for rows.Next() {
+		var gil GeneInLocus
+		err = rows.StructScan(&gil)
+		if err != nil {
+			return nil, err
+		}
+		genes[gil.Locus] = append(genes[gil.Locus], gil.Gene)
+	}
+	return genes, rows.Err()
+}
+
+// Loci of at least minDegree, by decreasing degree.
+func (g *CellGraph) Hubs(minDegree int) []LocusDegree {
+	// Degrees are sorted, so the hubs are a prefix.
+	n := sort.Search(len(g.Degrees), func(i int) bool { return g.Degrees[i].Degree < minDegree })
+	return g.Degrees[:n]
+}
+
+/** HTTP Routes **/
+
+// Paging only, as graph lists are held in memory.
+var cellGraphList = ListSpec{
+	Fields: map[string]ListField{},
+	Params: []string{"minDegree", "minSize"},
+}
+
+// Reads the cell type of a graph route and its graph, writing a response on failure.
+func graphFromRequest(w http.ResponseWriter, r *http.Request) (*CellGraph, bool) {
+	v := mux.Vars(r)
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return nil, false
+	}
+
+	g, err := GetCellGraph(cell.Type)
+	if err != nil {
+		writeError(w, err, "Could not analyse the Interactions of the Cell Type.")
+		return nil, false
+	}
+	return g, true
+}
+
+// Reads a non-negative integer query parameter, writing a response if it is invalid.
+func parseCountParam(w http.ResponseWriter, r *http.Request, name string, fallback int) (int, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, true
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("%s must be a non-negative integer.", name))
+		return 0, false
+	}
+	return value, true
+}
+
+func handleGetCellGraph(w http.ResponseWriter, r *http.Request) {
+	g, ok := graphFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(g.Summary)
+}
+
+func handleGetLocusDegrees(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseListParams(r, cellGraphList)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+	g, ok := graphFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	servePage(w, p, g.Degrees)
+}
+
+func handleGetHubs(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseListParams(r, cellGraphList)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+	minDegree, ok := parseCountParam(w, r, "minDegree", defaultHubDegree)
+	if !ok {
+		return
+	}
+	g, ok := graphFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	servePage(w, p, g.Hubs(minDegree))
+}
+
+func handleGetComponents(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseListParams(r, cellGraphList)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+	minSize, ok := parseCountParam(w, r, "minSize", 0)
+	if !ok {
+		return
+	}
+	g, ok := graphFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Components are sorted by decreasing size, so those large enough are a prefix.
+	n := sort.Search(len(g.Components), func(i int) bool { return g.Components[i].Size < minSize })
+	servePage(w, p, g.Components[:n])
+}
+
+func init() {
+	registerRoute(Route{path: "/celltypes/{type}/graph", handler: handleGetCellGraph, method: "GET",
+		summary: "Summarize the locus graph of the interactions of a cell type", response: GraphSummary{}})
+	registerRoute(Route{path: "/celltypes/{type}/graph/degrees", handler: handleGetLocusDegrees, method: "GET",
+		summary:  "List the degree of every locus in the interactions of a cell type, highest first",
+		response: []LocusDegree{}, query: []string{"limit", "offset"}})
+	registerRoute(Route{path: "/celltypes/{type}/graph/hubs", handler: handleGetHubs, method: "GET",
+		summary:  "List the loci of a cell type with at least minDegree neighbours, highest first",
+		response: []LocusDegree{}, query: []string{"minDegree", "limit", "offset"}})
+	registerRoute(Route{path: "/celltypes/{type}/graph/components", handler: handleGetComponents, method: "GET",
+		summary:  "List the connected components of the interactions of a cell type with their loci and genes, largest first",
+		response: []GraphComponent{}, query: []string{"minSize", "limit", "offset"}})
+}
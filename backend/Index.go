@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+/**
+Interval index using the UCSC binning scheme.
+Every interval is assigned the smallest bin which fully contains it. Bins are
+arranged in levels of 128kb, 1Mb, 8Mb, 64Mb and 512Mb, so any overlap query only
+has to look at the handful of bins covering the query interval on each level.
+Coordinates past 512Mb use the extended scheme with an extra 4Gb level.
+**/
+
+const (
+	binFirstShift          = 17
+	binNextShift           = 3
+	binStandardMax         = 1 << 29
+	binOffsetOldToExtended = 4681
+)
+
+var binOffsets = []int{512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+var binOffsetsExtended = []int{4096 + 512 + 64 + 8 + 1, 512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+
+func offsetsFor(end int) (offsets []int, base int) {
+	if end <= binStandardMax {
+		return binOffsets, 0
+	}
+	return binOffsetsExtended, binOffsetOldToExtended
+}
+
+// Returns the bin of the half-open interval [start, end).
+func binFromRange(start int, end int) int {
+	if end <= start {
+		end = start + 1
+	}
+	offsets, base := offsetsFor(end)
+	startBin := start >> binFirstShift
+	endBin := (end - 1) >> binFirstShift
+	for _, offset := range offsets {
+		if startBin == endBin {
+			return base + offset + startBin
+		}
+		startBin >>= binNextShift
+		endBin >>= binNextShift
+	}
+
+	// Unreachable for coordinates that fit in the top level.
+	return base
+}
+
+// Returns every bin which may hold an interval overlapping [start, end).
+// Extended bins are always included, since intervals crossing 512Mb live there.
+func binsOverlapping(start int, end int) []int {
+	if start < 0 {
+		start = 0
+	}
+	if end <= start {
+		end = start + 1
+	}
+
+	bins := make([]int, 0)
+	bins = appendLevelBins(bins, binOffsets, 0, start, end)
+	bins = appendLevelBins(bins, binOffsetsExtended, binOffsetOldToExtended, start, end)
+	return bins
+}
+
+func appendLevelBins(bins []int, offsets []int, base int, start int, end int) []int {
+	startBin := start >> binFirstShift
+	endBin := (end - 1) >> binFirstShift
+	for _, offset := range offsets {
+		for b := startBin; b <= endBin; b++ {
+			// The standard scheme only reaches 512Mb.
+			if base == 0 && offset+b >= binOffsetOldToExtended {
+				continue
+			}
+			bins = append(bins, base+offset+b)
+		}
+		startBin >>= binNextShift
+		endBin >>= binNextShift
+	}
+	return bins
+}
+
+/*
+Builds the WHERE fragment restricting rows of a table (optionally aliased) to
+those overlapping [start, end) on chr, using the (Chr, Bin) index.
+The column holding the interval end is given, since motif instances derive it.
+*/
+func overlapClause(alias string, endExpr string, chr string, start int, end int) (string, []interface{}) {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+
+	bins := binsOverlapping(start, end)
+	args := make([]interface{}, 0, len(bins)+3)
+	args = append(args, chr)
+	for _, b := range bins {
+		args = append(args, b)
+	}
+	args = append(args, end, start)
+
+	clause := fmt.Sprintf("%sChr=? AND %sBin IN (%s) AND %sStart < ? AND %s > ?",
+		prefix, prefix, placeholders(len(bins)), prefix, endExpr)
+	return clause, args
+}
+
+/** Backfill **/
+
+// Tables holding intervals, along with how to compute the end of each row.
+var indexedTables = []struct {
+	table string
+	query string
+}{
+	{"Loci", `SELECT rowid, Start, End FROM Loci`},
+	{"Genes", `SELECT rowid, Start, End FROM Genes`},
+	{"MotifInstances", `SELECT MI.rowid, MI.Start, MI.Start + MM.Length FROM MotifInstances AS MI INNER JOIN MotifModels AS MM ON MI.Model=MM.Name`},
+}
+
+func tableHasColumn(table string, column string) (exists bool, err error) {
+	query := `SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name=?`
+	err = db.Get(&exists, query, table, column)
+	return
+}
+
+/*
+Adds the Bin column and index to databases created before the interval index
+existed, then recomputes the bin of every row.
+*/
+func BackfillIndexes() error {
+	for _, t := range indexedTables {
+		exists, err := tableHasColumn(t.table, "Bin")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN Bin INT NOT NULL DEFAULT 0", t.table))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %sBinIndex ON %s (Chr, Bin)", t.table, t.table))
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(t.query)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		bins := make(map[int64]int)
+		for rows.Next() {
+			var rowid int64
+			var start, end int
+			err = rows.Scan(&rowid, &start, &end)
+			if err != nil {
+				rows.Close()
+				tx.Rollback()
+				return err
+			}
+			bins[rowid] = binFromRange(start, end)
+		}
+		rows.Close()
+
+		update := fmt.Sprintf("UPDATE %s SET Bin=? WHERE rowid=?", t.table)
+		for rowid, bin := range bins {
+			_, err = tx.Exec(update, bin, rowid)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[Info] Indexed %d rows of %s.\n", len(bins), t.table)
+	}
+
+	return nil
+}
+
+func init() {
+	registerCommand(Command{"RUN_INDEX_BACKFILL", func() {
+		err := BackfillIndexes()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}})
+}
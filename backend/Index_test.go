@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Bins as the UCSC binFromRange of kent's binRange.c gives them.
+func TestBinFromRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end int
+		want       int
+	}{
+		{"first base", 0, 1, 585},
+		{"empty interval", 0, 0, 585},
+		{"eighth 128kb bin", 1000000, 1000100, 592},
+		{"last base before 128kb", 131071, 131072, 585},
+		{"first base after 128kb", 131072, 131073, 586},
+		{"across 128kb", 131071, 131073, 73},
+		{"across 1Mb", 1048575, 1048577, 9},
+		{"across 8Mb", 8388607, 8388609, 1},
+		{"across 64Mb", 67108863, 67108865, 0},
+		{"whole standard range", 0, 1 << 29, 0},
+		{"across several 64Mb", 100000000, 400000000, 0},
+		{"first extended 128kb bin", 1 << 29, 1<<29 + 1, 4681 + 4681 + 4096},
+		{"across 512Mb", 1<<29 - 1, 1<<29 + 1, 4681},
+	}
+	for _, tt := range tests {
+		if got := binFromRange(tt.start, tt.end); got != tt.want {
+			t.Errorf("%s: binFromRange(%d, %d) = %d, want %d", tt.name, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+// Every interval overlapping a query lives in one of the bins looked at.
+func TestBinsOverlapping(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Intervals of every level, some crossing 512Mb.
+	lengths := []int{1, 1000, 1 << 17, 1 << 20, 1 << 23, 1 << 26, 1 << 28}
+	interval := func() (int, int) {
+		start := rng.Intn(1<<29 + 1<<27)
+		return start, start + 1 + rng.Intn(lengths[rng.Intn(len(lengths))])
+	}
+
+	for i := 0; i < 2000; i++ {
+		qStart, qEnd := interval()
+		bins := make(map[int]bool)
+		for _, b := range binsOverlapping(qStart, qEnd) {
+			bins[b] = true
+		}
+		for j := 0; j < 50; j++ {
+			start, end := interval()
+			if j == 0 {
+				// One interval is always right next to the query start.
+				start, end = qStart-1+rng.Intn(2), qStart+1+rng.Intn(1000)
+			}
+			if !overlaps(start, end, qStart, qEnd) {
+				continue
+			}
+			if b := binFromRange(start, end); !bins[b] {
+				t.Fatalf("%d-%d overlaps the query %d-%d, but its bin %d is not looked at", start, end, qStart, qEnd, b)
+			}
+		}
+	}
+}
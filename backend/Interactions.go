@@ -1,28 +1,246 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
 type InteractionParticipation struct {
 	Locus       string `json:"Locus" db:"Locus"`
-	Interaction string `json:"Interaction" db:"Interaction"`
+	Interaction int64  `json:"Interaction" db:"Interaction"`
 }
 
+/*
+An interaction between two or more anchor loci, with the loci embedded.
+AnchorCount, Cis, Trans and Span are derived from the loci by interactionsQuery.
+Span runs from the first start to the last end of the anchors, and is only
+known for cis interactions, whose anchors are all on one chromosome.
+SupportCount is the number of times the interaction was created, as creating
+one with the anchors of an existing one only counts towards it.
+ContactCount, PValue, QValue and Caller are given by the loop caller which
+found the interaction, and are null when not known.
+*/
 type Interaction struct {
-	CellType string `json:"CellType" db:"CellType"`
-	ID       int64  `json:"ID" db:"ID"`
+	CellType     string   `json:"CellType" db:"CellType"`
+	ID           int64    `json:"ID" db:"ID"`
+	SupportCount int      `json:"SupportCount" db:"SupportCount"`
+	ContactCount *int     `json:"ContactCount" db:"ContactCount"`
+	PValue       *float64 `json:"PValue" db:"PValue"`
+	QValue       *float64 `json:"QValue" db:"QValue"`
+	Caller       *string  `json:"Caller" db:"Caller"`
+	AnchorCount  int      `json:"AnchorCount" db:"AnchorCount"`
+	Cis          bool     `json:"Cis" db:"Cis"`
+	Trans        bool     `json:"Trans" db:"Trans"`
+	Span         *int     `json:"Span" db:"Span"`
+	Loci         []Locus  `json:"Loci" db:"-"`
 }
 
-func (c CellType) GetInteractions() (its []Interaction, err error) {
-	query := "SELECT * FROM Interactions WHERE CellType=?"
-	rows, err := db.Queryx(query, c.Type)
+// A locus joined with the interaction it is an anchor of.
+type anchorRow struct {
+	Interaction int64 `db:"Interaction"`
+	Locus
+}
+
+var interactionList = ListSpec{
+	Fields: map[string]ListField{
+		"celltype":     {"CellType", fieldString},
+		"id":           {"ID", fieldInt},
+		"supportcount": {"SupportCount", fieldInt},
+		"contactcount": {"ContactCount", fieldInt},
+		"pvalue":       {"PValue", fieldFloat},
+		"qvalue":       {"QValue", fieldFloat},
+		"caller":       {"Caller", fieldString},
+		"anchorcount":  {"AnchorCount", fieldInt},
+		"cis":          {"Cis", fieldBool},
+		"trans":        {"Trans", fieldBool},
+		"span":         {"Span", fieldInt},
+	},
+	Named: map[string]NamedFilter{
+		"mindistance": {"span", ">="},
+		"maxdistance": {"span", "<="},
+		"minsupport":  {"supportcount", ">="},
+		"mincount":    {"contactcount", ">="},
+		"maxp":        {"pvalue", "<="},
+		"maxq":        {"qvalue", "<="},
+	},
+	Order: "ID",
+}
+
+/*
+Selects interactions along with the properties derived from their loci. Where
+filters the interactions, having their derived properties.
+*/
+func interactionsQuery(where string, having string) string {
+	query := `SELECT I.CellType, I.ID, I.SupportCount, I.ContactCount, I.PValue, I.QValue, I.Caller, COUNT(L.ID) AS AnchorCount,
+		COUNT(DISTINCT L.Chr) = 1 AS Cis, COUNT(DISTINCT L.Chr) > 1 AS Trans,
+		CASE WHEN COUNT(DISTINCT L.Chr) = 1 THEN MAX(L.End) - MIN(L.Start) END AS Span
+		FROM Interactions AS I
+		LEFT JOIN InteractionParticipation AS P ON P.Interaction=I.ID
+		LEFT JOIN Loci AS L ON L.ID=P.Locus`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " GROUP BY I.ID"
+	if having != "" {
+		query += " HAVING " + having
+	}
+	return query
+}
+
+// Limits interactions by their derived properties and attributes. Zero values do not filter.
+type InteractionFilter struct {
+	MinDistance int
+	MaxDistance int
+	Cis         bool
+	Trans       bool
+	MinSupport  int
+	MinCount    int
+	MaxP        *float64
+	MaxQ        *float64
+	Caller      string
+}
+
+/*
+Returns the conditions on the stored attributes of interactions, with columns
+prefixed by an alias such as "I.". Interactions without an attribute never
+pass a filter on it.
+*/
+func (f InteractionFilter) attributeConditions(prefix string) ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.MinSupport > 0 {
+		conditions = append(conditions, prefix+"SupportCount >= ?")
+		args = append(args, f.MinSupport)
+	}
+	if f.MinCount > 0 {
+		conditions = append(conditions, prefix+"ContactCount >= ?")
+		args = append(args, f.MinCount)
+	}
+	if f.MaxP != nil {
+		conditions = append(conditions, prefix+"PValue <= ?")
+		args = append(args, *f.MaxP)
+	}
+	if f.MaxQ != nil {
+		conditions = append(conditions, prefix+"QValue <= ?")
+		args = append(args, *f.MaxQ)
+	}
+	if f.Caller != "" {
+		conditions = append(conditions, prefix+"Caller = ?")
+		args = append(args, f.Caller)
+	}
+	return conditions, args
+}
+
+// Returns the HAVING clause of interactionsQuery applying the filter, and its args.
+func (f InteractionFilter) having() (string, []interface{}) {
+	conditions, args := f.attributeConditions("")
+	if f.MinDistance > 0 {
+		conditions = append(conditions, "Span >= ?")
+		args = append(args, f.MinDistance)
+	}
+	if f.MaxDistance > 0 {
+		conditions = append(conditions, "Span <= ?")
+		args = append(args, f.MaxDistance)
+	}
+	if f.Cis {
+		conditions = append(conditions, "Cis")
+	}
+	if f.Trans {
+		conditions = append(conditions, "Trans")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+const interactionLociQuery = "SELECT L.* FROM Loci AS L INNER JOIN InteractionParticipation AS I ON I.Locus=L.ID WHERE I.Interaction=?"
+
+// Fills in the loci of every interaction with a single join.
+func fillInteractionLoci(its []Interaction) error {
+	index := make(map[int64]int, len(its))
+	ids := make([]int64, len(its))
+	for i := range its {
+		its[i].Loci = make([]Locus, 0)
+		index[its[i].ID] = i
+		ids[i] = its[i].ID
+	}
+
+	return eachInChunk(ids, func(args []interface{}) error {
+		query := fmt.Sprintf(`SELECT I.Interaction, L.* FROM InteractionParticipation AS I INNER JOIN Loci AS L ON I.Locus=L.ID
+			WHERE I.Interaction IN (%s) ORDER BY L.Chr, L.Start, L.End`, placeholders(len(args)))
+		rows, err := db.Queryx(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var a anchorRow
+			err = rows.StructScan(&a)
+			if err != nil {
+				return err
+			}
+			i := index[a.Interaction]
+			its[i].Loci = append(its[i].Loci, a.Locus)
+		}
+
+		return rows.Err()
+	})
+}
+
+func (it Interaction) fillList(its []Interaction) error {
+	return fillInteractionLoci(its)
+}
+
+func (it Interaction) Formats() []string {
+	return []string{formatBEDPE, formatTSV}
+}
+
+func (it Interaction) Header(format string) []string {
+	if format == formatTSV {
+		return []string{"ID", "CellType", "AnchorCount", "Anchors", "SupportCount", "ContactCount", "PValue", "QValue", "Caller"}
+	}
+	return nil
+}
+
+// BEDPE has exactly two anchors, so n-wise interactions are written once per pair.
+func (it Interaction) Rows(format string) ([][]string, error) {
+	loci := it.Loci
+	id := strconv.FormatInt(it.ID, 10)
+
+	if format == formatTSV {
+		anchors := make([]string, len(loci))
+		for i, l := range loci {
+			anchors[i] = l.ID
+		}
+		return [][]string{{id, it.CellType, strconv.Itoa(len(loci)), strings.Join(anchors, ","), strconv.Itoa(it.SupportCount),
+			optionalInt(it.ContactCount), optionalFloat(it.PValue), optionalFloat(it.QValue), optionalString(it.Caller)}}, nil
+	}
+
+	rows := make([][]string, 0)
+	for i := 0; i < len(loci); i++ {
+		for j := i + 1; j < len(loci); j++ {
+			a, b := loci[i], loci[j]
+			rows = append(rows, []string{
+				a.Chr, strconv.Itoa(a.Start), strconv.Itoa(a.End),
+				b.Chr, strconv.Itoa(b.Start), strconv.Itoa(b.End),
+				id, strconv.Itoa(it.SupportCount), ".", ".",
+			})
+		}
+	}
+	return rows, nil
+}
+
+func (c CellType) GetInteractions(filter InteractionFilter) (its []Interaction, err error) {
+	having, args := filter.having()
+	query := interactionsQuery("I.CellType=?", having)
+	rows, err := db.Queryx(query, append([]interface{}{c.Type}, args...)...)
 	if err != nil {
 		return []Interaction{}, err
 	}
@@ -35,66 +253,308 @@ func (c CellType) GetInteractions() (its []Interaction, err error) {
 		its = append(its, it)
 	}
 
+	err = fillInteractionLoci(its)
 	return
 }
 
-func (it Interaction) GetLoci() (loci []Locus, err error) {
-	query := "SELECT L.* FROM Loci AS L INNER JOIN InteractionParticipation AS I ON I.Locus=L.ID WHERE I.Interaction=?"
-	rows, err := db.Queryx(query, it.ID)
+// TODO: This is a good spot to implement interesting interaction logic.
+
+// Creates the interaction and any of its loci which do not exist yet, all or nothing.
+func (it Interaction) Create() (newid int64, err error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		return []Locus{}, err
+		return 0, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	loci = make([]Locus, 0)
-	for rows.Next() {
-		var loc Locus
-		rows.StructScan(&loc)
-		loci = append(loci, loc)
+	newid, err = createInteraction(tx, it)
+	if err != nil {
+		return 0, err
 	}
 
-	return
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	invalidateGraph(it.CellType)
+	return newid, nil
 }
 
-// TODO: This is a good spot to implement interesting interaction logic.
-// TODO: Implement interactions with Nested structs, as a flat struct makes no sense outside the database.
+/*
+Creates many interactions of two or more anchors in a single transaction, along
+with any missing loci. Every item is attempted, so that all failures can be
+reported at once in a BulkError, but nothing is kept unless all succeed.
+Returns the IDs of the new interactions, in the order given.
+*/
+func CreateInteractions(its []Interaction) (ids []int64, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids = make([]int64, len(its))
+	failed := make([]ItemError, 0)
+	for i, it := range its {
+		if it.CellType == "" {
+			failed = append(failed, itemError(i, invalid("CellType is missing.")))
+			continue
+		}
+		if len(it.Loci) < 2 {
+			failed = append(failed, itemError(i, invalid("An Interaction needs at least two Loci, got %d.", len(it.Loci))))
+			continue
+		}
 
-// We won't implement a function to create multiple interactions simultaneously until we have the Nested struct implemented.
-func (it Interaction) Create() (newid int64, err error) {
-	query := "INSERT INTO Interactions (CellType) VALUES (?)"
-	result, err := db.Exec(query, it.CellType)
+		// Each item is undone on its own when it fails, so later items are
+		// checked and deduplicated only against those which succeeded.
+		_, err = tx.Exec("SAVEPOINT item")
+		if err != nil {
+			return nil, err
+		}
+		ids[i], err = createInteraction(tx, it)
+		if err != nil {
+			failed = append(failed, itemError(i, err))
+			_, err = tx.Exec("ROLLBACK TO item")
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec("RELEASE item")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(failed) > 0 {
+		return nil, BulkError{failed}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range its {
+		invalidateGraph(it.CellType)
+	}
+	return ids, nil
+}
+
+// Checks the attributes given by a loop caller are in range.
+func (it Interaction) validateAttributes() error {
+	if it.ContactCount != nil && *it.ContactCount < 0 {
+		return invalid("ContactCount must not be negative, got %d.", *it.ContactCount)
+	}
+	if it.PValue != nil && (*it.PValue < 0 || *it.PValue > 1) {
+		return invalid("PValue must be from 0 to 1, got %g.", *it.PValue)
+	}
+	if it.QValue != nil && (*it.QValue < 0 || *it.QValue > 1) {
+		return invalid("QValue must be from 0 to 1, got %g.", *it.QValue)
+	}
+	return nil
+}
+
+func createInteraction(tx *sqlx.Tx, it Interaction) (newid int64, err error) {
+	err = it.validateAttributes()
 	if err != nil {
 		return 0, err
 	}
 
-	newid, err = result.LastInsertId()
+	loci := make([]Locus, len(it.Loci))
+	seen := make(map[string]bool, len(it.Loci))
+	for i, l := range it.Loci {
+		loci[i], err = l.Normalize()
+		if err != nil {
+			return 0, invalid("Invalid Locus at index %d: %s", i, err.Error())
+		}
+		if seen[loci[i].ID] {
+			return 0, invalid("Locus %s is an anchor more than once.", loci[i].ID)
+		}
+		seen[loci[i].ID] = true
+	}
+
+	// A duplicate of an existing interaction only adds to its support, and fills
+	// in the attributes it does not have yet.
+	signature := interactionSignature(loci)
+	if signature != nil {
+		err = tx.Get(&newid, "SELECT ID FROM Interactions WHERE CellType=? AND Signature=?", it.CellType, signature)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE Interactions SET SupportCount=SupportCount+1, ContactCount=IFNULL(ContactCount, ?),
+				PValue=IFNULL(PValue, ?), QValue=IFNULL(QValue, ?), Caller=IFNULL(Caller, ?) WHERE ID=?`,
+				it.ContactCount, it.PValue, it.QValue, it.Caller, newid)
+			return newid, dbError(err)
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	// IDs are assigned here rather than by SQLite, as databases created before ID
+	// was an INTEGER PRIMARY KEY leave it empty.
+	err = tx.Get(&newid, "SELECT IFNULL(MAX(ID), 0) + 1 FROM Interactions")
 	if err != nil {
 		return 0, err
 	}
+	_, err = tx.Exec(`INSERT INTO Interactions (CellType, ID, Signature, ContactCount, PValue, QValue, Caller)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, it.CellType, newid, signature, it.ContactCount, it.PValue, it.QValue, it.Caller)
+	if err != nil {
+		return 0, dbError(err)
+	}
 
-	return
+	for _, l := range loci {
+		err = createLocusIfMissing(tx, l)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("INSERT INTO InteractionParticipation (Locus, Interaction) VALUES (?, ?)", l.ID, newid)
+		if err != nil {
+			return 0, dbError(err)
+		}
+	}
+
+	return newid, nil
 }
 
+// Removes the interaction along with its participation rows.
 func (it Interaction) Delete() (err error) {
-	query := "DELETE FROM Interactions WHERE ID=?"
-	_, err = db.Exec(query, it.ID)
-	return
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM InteractionParticipation WHERE Interaction=?", it.ID)
+	if err != nil {
+		return dbError(err)
+	}
+	_, err = tx.Exec("DELETE FROM Interactions WHERE ID=?", it.ID)
+	if err != nil {
+		return dbError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	invalidateGraph(it.CellType)
+	return nil
+}
+
+/*
+The canonical form of an anchor set: the IDs of its normalized loci in order of
+chromosome, start and end. Interactions without anchors have no signature, so
+any number of them can be created and filled in later.
+*/
+func interactionSignature(loci []Locus) *string {
+	if len(loci) == 0 {
+		return nil
+	}
+	sorted := make([]Locus, len(loci))
+	copy(sorted, loci)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Chr != sorted[j].Chr {
+			return sorted[i].Chr < sorted[j].Chr
+		}
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].End < sorted[j].End
+	})
+
+	ids := make([]string, len(sorted))
+	for i, l := range sorted {
+		ids[i] = l.ID
+	}
+	signature := strings.Join(ids, ",")
+	return &signature
+}
+
+// Recomputes the signature of an interaction after its anchors changed.
+func updateSignature(tx *sqlx.Tx, id int64) error {
+	loci := make([]Locus, 0)
+	err := tx.Select(&loci, interactionLociQuery, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE Interactions SET Signature=? WHERE ID=?", interactionSignature(loci), id)
+	return dbError(err)
+}
+
+// Changes the anchors of an interaction with query, a conflict if it then duplicates another.
+func (it Interaction) changeAnchors(query string, args ...interface{}) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		return dbError(err)
+	}
+	err = updateSignature(tx, it.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	invalidateGraph(it.CellType)
+	return nil
 }
 
 func (it Interaction) AddLocus(ID string) (err error) {
-	query := "INSERT INTO InteractionParticipation VALUES (?, ?)"
-	_, err = db.Exec(query, ID, it.ID)
-	return
+	return it.changeAnchors("INSERT INTO InteractionParticipation VALUES (?, ?)", ID, it.ID)
 }
 
 func (it Interaction) RemoveLocus(ID string) (err error) {
-	query := "DELETE FROM InteractionParticipation WHERE Locus=? AND Interaction=?"
-	_, err = db.Exec(query, ID, it.ID)
-	return
+	return it.changeAnchors("DELETE FROM InteractionParticipation WHERE Locus=? AND Interaction=?", ID, it.ID)
+}
+
+/*
+Saves the cell type and attributes of an existing interaction, moving it to
+another cell type if they differ. Its anchors are changed through AddLocus
+and RemoveLocus instead. Moving onto a duplicate of the anchors is a conflict.
+*/
+func (it Interaction) Save() (err error) {
+	err = it.validateAttributes()
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldCellType string
+	err = tx.Get(&oldCellType, "SELECT CellType FROM Interactions WHERE ID=?", it.ID)
+	if err == sql.ErrNoRows {
+		return notFound("Interaction")
+	}
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE Interactions SET CellType=?, ContactCount=?, PValue=?, QValue=?, Caller=? WHERE ID=?`
+	_, err = tx.Exec(query, it.CellType, it.ContactCount, it.PValue, it.QValue, it.Caller, it.ID)
+	if err != nil {
+		return dbError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	invalidateGraph(oldCellType)
+	invalidateGraph(it.CellType)
+	return nil
 }
 
 func GetInteraction(ID int64) (it Interaction, err error) {
-	query := "SELECT * FROM Interactions WHERE ID=?"
+	query := interactionsQuery("I.ID=?", "")
 	rows, err := db.Queryx(query, ID)
 	if err != nil {
 		return Interaction{}, err
@@ -103,46 +563,100 @@ func GetInteraction(ID int64) (it Interaction, err error) {
 
 	if rows.Next() {
 		rows.StructScan(&it)
-		return
+		rows.Close()
+		its := []Interaction{it}
+		err = fillInteractionLoci(its)
+		return its[0], err
 	}
 
-	return Interaction{}, errors.New("not_found")
+	return Interaction{}, notFound("Interaction")
 }
 
-// Creating interactions is handled by the CellType routes.
-func handleAddLocusToInteraction(w http.ResponseWriter, r *http.Request) {
-	v := mux.Vars(r)
-	key, err := strconv.ParseInt(v["id"], 10, 64)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid ID.")
-		return
+// The query parameters of InteractionFilter attributes, as given to list endpoints.
+var interactionFilterParams = []string{"minSupport", "minCount", "maxP", "maxQ", "caller"}
+
+/*
+Reads the attribute filters of endpoints which are not lists, such as
+comparisons, under the same names as the Named filters of interactionList.
+*/
+func parseInteractionFilter(r *http.Request) (f InteractionFilter, err error) {
+	values := make(map[string]string)
+	for key, given := range r.URL.Query() {
+		values[strings.ToLower(key)] = given[0]
 	}
 
-	it, err := GetInteraction(key)
-	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Interaction.")
+	for _, name := range []string{"minSupport", "minCount"} {
+		raw := values[strings.ToLower(name)]
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		if name == "minSupport" {
+			f.MinSupport = n
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Interactions.")
+			f.MinCount = n
 		}
+	}
+	for _, name := range []string{"maxP", "maxQ"} {
+		raw := values[strings.ToLower(name)]
+		if raw == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return f, fmt.Errorf("%s must be a number", name)
+		}
+		if name == "maxP" {
+			f.MaxP = &x
+		} else {
+			f.MaxQ = &x
+		}
+	}
+	f.Caller = values["caller"]
+	return f, nil
+}
+
+// Reads the interaction of a route by its ID, writing a response if it is invalid or missing.
+func interactionFromRequest(w http.ResponseWriter, r *http.Request) (Interaction, bool) {
+	v := mux.Vars(r)
+	id, err := strconv.ParseInt(v["id"], 10, 64)
+	if err != nil || id < 1 {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Interaction IDs are positive integers, got "+v["id"]+".")
+		return Interaction{}, false
+	}
+
+	it, err := GetInteraction(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Interactions.")
+		return Interaction{}, false
+	}
+	return it, true
+}
+
+// Creating interactions is handled by the CellType routes.
+func handleAddLocusToInteraction(w http.ResponseWriter, r *http.Request) {
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
 		return
 	}
 
 	var locid string
-	err = json.NewDecoder(r.Body).Decode(&locid)
+	err := json.NewDecoder(r.Body).Decode(&locid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Body should be a string representing a Locus ID")
+		writeBadRequest(w, "Body should be a string representing a Locus ID")
+		return
+	}
+	locid, ok = parseLocusID(w, locid)
+	if !ok {
 		return
 	}
 
 	err = it.AddLocus(locid)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not add Locus to Interaction.\n", err.Error())
+		writeError(w, err, "Could not add Locus to Interaction.")
 		return
 	}
 
@@ -150,30 +664,19 @@ func handleAddLocusToInteraction(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleRemoveLocusFromInteraction(w http.ResponseWriter, r *http.Request) {
-	v := mux.Vars(r)
-	key, err := strconv.ParseInt(v["id"], 10, 64)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid ID.")
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	it, err := GetInteraction(key)
-	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Interaction.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Interactions.")
-		}
+	locid, ok := parseLocusID(w, mux.Vars(r)["loc"])
+	if !ok {
 		return
 	}
 
-	err = it.RemoveLocus(v["loc"])
+	err := it.RemoveLocus(locid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Could not delete Locus from Interaction.")
+		writeError(w, err, "Could not delete Locus from Interaction.")
 		return
 	}
 
@@ -182,70 +685,154 @@ func handleRemoveLocusFromInteraction(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleDeleteInteraction(w http.ResponseWriter, r *http.Request) {
-	v := mux.Vars(r)
-	key, err := strconv.ParseInt(v["id"], 10, 64)
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := it.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid ID.")
+		writeError(w, err, "Could not delete Interaction.")
 		return
 	}
 
-	it, err := GetInteraction(key)
+	fmt.Fprint(w, "Interaction deleted.")
+}
+
+/*
+Fields left out of the body keep their values, while null clears an attribute.
+Only the cell type and attributes are saved, see Interaction.Save.
+*/
+func handleEditInteraction(w http.ResponseWriter, r *http.Request) {
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := it.ID
+	err := json.NewDecoder(r.Body).Decode(&it)
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Interaction.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Interactions.")
-		}
+		writeBadRequest(w, "Request body must be an Interaction.")
+		return
+	}
+	it.ID = id
+	if it.CellType == "" {
+		writeProblem(w, http.StatusUnprocessableEntity, "validation", "CellType must not be empty.")
 		return
 	}
 
-	err = it.Delete()
+	err = it.Save()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Interaction.")
+		writeError(w, err, "Could not save Interaction.")
 		return
 	}
 
-	fmt.Fprint(w, "Interaction deleted.")
+	it, err = GetInteraction(id)
+	if err != nil {
+		writeError(w, err, "Saved Interaction, but could not fetch it.")
+		return
+	}
+	json.NewEncoder(w).Encode(it)
 }
 
-func handleGetInteractionLoci(w http.ResponseWriter, r *http.Request) {
-	v := mux.Vars(r)
-	key, err := strconv.ParseInt(v["id"], 10, 64)
+func handleCreateInteractions(w http.ResponseWriter, r *http.Request) {
+	its := make([]Interaction, 0)
+	err := json.NewDecoder(r.Body).Decode(&its)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid ID.")
+		writeBadRequest(w, "Request body must be an array of Interactions with their Loci.")
 		return
 	}
 
-	it, err := GetInteraction(key)
+	ids, err := CreateInteractions(its)
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Interaction.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Interactions.")
-		}
+		writeError(w, err, "Could not create Interactions.")
 		return
 	}
 
-	loc, err := it.GetLoci()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Loci.")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ids)
+}
+
+func handleGetInteraction(w http.ResponseWriter, r *http.Request) {
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(it)
+}
+
+func handleGetInteractionLoci(w http.ResponseWriter, r *http.Request) {
+	it, ok := interactionFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	json.NewEncoder(w).Encode(loc)
+	serveList[Locus](w, r, locusList, "Loci", interactionLociQuery, it.ID)
+}
+
+/*
+Databases created before InteractionParticipation.Interaction was an INTEGER
+stored the IDs of interactions as text. SQLite cannot change the type of a
+column, so the table is rebuilt, failing if any ID is not an integer.
+*/
+var participationIntegerMigration = Migration{
+	name: "make InteractionParticipation.Interaction an INTEGER",
+	needed: func() (bool, error) {
+		var columnType string
+		err := db.Get(&columnType, `SELECT type FROM pragma_table_info('InteractionParticipation') WHERE name='Interaction'`)
+		return strings.ToUpper(columnType) != "INTEGER", err
+	},
+	apply: func(tx *sqlx.Tx) error {
+		var invalidIDs int
+		err := tx.Get(&invalidIDs, `SELECT COUNT(*) FROM InteractionParticipation
+			WHERE CAST(CAST(Interaction AS INTEGER) AS TEXT) <> CAST(Interaction AS TEXT)`)
+		if err != nil {
+			return err
+		}
+		if invalidIDs > 0 {
+			return fmt.Errorf("%d rows of InteractionParticipation refer to an Interaction by an ID which is not an integer", invalidIDs)
+		}
+
+		for _, statement := range []string{
+			`CREATE TABLE InteractionParticipationInteger (
+				Locus varchar(255),
+				Interaction INTEGER NOT NULL,
+				FOREIGN KEY (Locus) REFERENCES Loci(ID),
+				FOREIGN KEY (Interaction) REFERENCES Interactions(ID),
+				PRIMARY KEY (Locus, Interaction),
+				Check (typeof(Interaction) = 'integer')
+			)`,
+			`INSERT INTO InteractionParticipationInteger (Locus, Interaction)
+				SELECT Locus, CAST(Interaction AS INTEGER) FROM InteractionParticipation`,
+			`DROP TABLE InteractionParticipation`,
+			`ALTER TABLE InteractionParticipationInteger RENAME TO InteractionParticipation`,
+			`CREATE INDEX InteractionParticipationInteractionIndex ON InteractionParticipation (Interaction)`,
+		} {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				return dbError(err)
+			}
+		}
+		return nil
+	},
 }
 
 func init() {
-	registerRoute(Route{"/interactions/{id}/loci", handleGetInteractionLoci, "GET"})
-	registerRoute(Route{"/interactions/{id}/loci", handleAddLocusToInteraction, "POST"})
-	registerRoute(Route{"/interactions/{id}/loci/{loc}", handleRemoveLocusFromInteraction, "DELETE"})
-	registerRoute(Route{"/interactions/{id}", handleDeleteInteraction, "DELETE"})
+	registerMigration(participationIntegerMigration)
+
+	registerRoute(Route{path: "/interactions", handler: handleCreateInteractions, method: "POST",
+		summary: "Create many interactions along with any missing loci, all or nothing", body: []Interaction{}, response: []int64{}})
+	registerRoute(Route{path: "/interactions/{id}/loci", handler: handleGetInteractionLoci, method: "GET",
+		summary: "List the anchor loci of an interaction", response: []Locus{}, list: &locusList})
+	registerRoute(Route{path: "/interactions/{id}/loci", handler: handleAddLocusToInteraction, method: "POST",
+		summary: "Add an anchor locus to an interaction, given its ID", body: ""})
+	registerRoute(Route{path: "/interactions/{id}/loci/{loc}", handler: handleRemoveLocusFromInteraction, method: "DELETE",
+		summary: "Remove an anchor locus from an interaction"})
+	registerRoute(Route{path: "/interactions/{id}", handler: handleGetInteraction, method: "GET",
+		summary: "Get an interaction with its anchor loci", response: Interaction{}})
+	registerRoute(Route{path: "/interactions/{id}", handler: handleEditInteraction, method: "PUT",
+		summary: "Change the cell type and attributes of an interaction", body: Interaction{}, response: Interaction{}})
+	registerRoute(Route{path: "/interactions/{id}", handler: handleDeleteInteraction, method: "DELETE",
+		summary: "Delete an interaction"})
 }
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/**
+Shared list query builder
+Every list endpoint accepts the same query parameters:
+  limit=50, offset=100         Page through results.
+  sort=start,-end              Sort by whitelisted fields, "-" for descending.
+  chr=chrX, start>=1000,       Filter by whitelisted fields with one of
+  quality=A, expression>5      =, !=, <, <=, > or >=.
+The total number of matching rows is returned in the X-Total-Count header.
+Clients sending "Accept: application/x-ndjson" (or format=ndjson) receive one
+JSON object per line, streamed from the database cursor rather than collected
+in memory first. Streams go without X-Total-Count, which would need a second
+pass over the rows. Entities with tabular forms can also be streamed as BED, BEDPE
+or TSV, see Formats.go.
+**/
+
+type fieldKind int
+
+const (
+	fieldString fieldKind = iota
+	fieldInt
+	fieldFloat
+	fieldBool
+	fieldChar // Single characters stored by their byte value, such as MotifModel.Quality.
+	fieldChr  // Chromosome names, normalized like any other chromosome.
+)
+
+// A field clients may filter and sort a list by.
+type ListField struct {
+	Column string
+	Kind   fieldKind
+}
+
+// A filter named for what it does, such as minDistance=1000, comparing a field of the spec with a fixed operator.
+type NamedFilter struct {
+	Field string
+	Op    string
+}
+
+/*
+Describes what a list may be filtered and sorted by. Fields and Named filters
+are keyed by their lowercase query parameter name. Order is always appended to
+the requested sort, so pages are stable. Params are other query parameters the
+endpoint reads itself.
+*/
+type ListSpec struct {
+	Fields map[string]ListField
+	Named  map[string]NamedFilter
+	Order  string
+	Params []string
+}
+
+type listFilter struct {
+	column string
+	op     string
+	value  interface{}
+}
+
+type listSort struct {
+	column string
+	desc   bool
+}
+
+type ListParams struct {
+	Limit   int
+	Offset  int
+	Filters []listFilter
+	Sort    []listSort
+}
+
+// Parameters every list understands, outside of the fields of the spec.
+var reservedListParams = map[string]bool{"limit": true, "offset": true, "sort": true, "format": true}
+
+// Operators are checked longest first, so ">=" is not read as ">".
+var listOperators = []string{">=", "<=", "!=", ">", "<", "="}
+
+func parseFieldValue(field ListField, raw string) (interface{}, error) {
+	switch field.Kind {
+	case fieldInt:
+		return strconv.ParseInt(raw, 10, 64)
+	case fieldFloat:
+		return strconv.ParseFloat(raw, 64)
+	case fieldBool:
+		return strconv.ParseBool(raw)
+	case fieldChar:
+		if len(raw) != 1 {
+			return nil, fmt.Errorf("must be a single character")
+		}
+		return int(raw[0]), nil
+	case fieldChr:
+		return normalizeChrName(raw), nil
+	}
+	return raw, nil
+}
+
+/*
+Reads list parameters from the raw query string, since filters such as
+"start>=1000" and "expression>5" do not survive url.Values parsing.
+*/
+func ParseListParams(r *http.Request, spec ListSpec) (p ListParams, err error) {
+	passthrough := make(map[string]bool)
+	for _, param := range spec.Params {
+		passthrough[strings.ToLower(param)] = true
+	}
+
+	for _, term := range strings.Split(r.URL.RawQuery, "&") {
+		if term == "" {
+			continue
+		}
+		term, err = url.QueryUnescape(term)
+		if err != nil {
+			return p, fmt.Errorf("could not decode query parameter %s", term)
+		}
+
+		pos := strings.IndexAny(term, "<>!=")
+		if pos < 0 {
+			pos = len(term)
+		}
+		name := strings.ToLower(strings.TrimSpace(term[:pos]))
+		op := ""
+		for _, candidate := range listOperators {
+			if strings.HasPrefix(term[pos:], candidate) {
+				op = candidate
+				break
+			}
+		}
+		value := strings.TrimSpace(term[pos+len(op):])
+
+		if passthrough[name] {
+			continue
+		}
+
+		if reservedListParams[name] {
+			if op != "=" {
+				return p, fmt.Errorf("%s must be given as %s=value", name, name)
+			}
+			switch name {
+			case "limit":
+				p.Limit, err = strconv.Atoi(value)
+				if err != nil || p.Limit < 1 {
+					return p, fmt.Errorf("limit must be a positive integer")
+				}
+			case "offset":
+				p.Offset, err = strconv.Atoi(value)
+				if err != nil || p.Offset < 0 {
+					return p, fmt.Errorf("offset must be a non-negative integer")
+				}
+			case "format":
+				// Read by negotiateFormat.
+			case "sort":
+				for _, key := range strings.Split(value, ",") {
+					s := listSort{}
+					if strings.HasPrefix(key, "-") {
+						s.desc = true
+						key = key[1:]
+					}
+					field, ok := spec.Fields[strings.ToLower(key)]
+					if !ok {
+						return p, fmt.Errorf("cannot sort by %s", key)
+					}
+					s.column = field.Column
+					p.Sort = append(p.Sort, s)
+				}
+			}
+			continue
+		}
+
+		if named, ok := spec.Named[name]; ok {
+			if op != "=" {
+				return p, fmt.Errorf("%s must be given as %s=value", name, name)
+			}
+			name, op = named.Field, named.Op
+		}
+
+		field, ok := spec.Fields[name]
+		if !ok {
+			return p, fmt.Errorf("cannot filter by %s", name)
+		}
+		if op == "" {
+			return p, fmt.Errorf("filter on %s needs an operator and value", name)
+		}
+		parsed, err := parseFieldValue(field, value)
+		if err != nil {
+			return p, fmt.Errorf("invalid value for %s: %s", name, value)
+		}
+		p.Filters = append(p.Filters, listFilter{field.Column, op, parsed})
+	}
+
+	return p, nil
+}
+
+// Returns the WHERE fragment applying the filters of the params, and its args.
+func (p ListParams) where() (string, []interface{}) {
+	if len(p.Filters) == 0 {
+		return "", []interface{}{}
+	}
+
+	conditions := make([]string, len(p.Filters))
+	args := make([]interface{}, len(p.Filters))
+	for i, f := range p.Filters {
+		conditions[i] = fmt.Sprintf("%s %s ?", f.column, f.op)
+		args[i] = f.value
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+/*
+Builds the page and count queries over a base query. The base is used as a
+subquery, so the columns of the spec refer to the columns it selects.
+*/
+func (p ListParams) build(base string, baseArgs []interface{}, order string) (query string, args []interface{}, countQuery string, countArgs []interface{}) {
+	where, whereArgs := p.where()
+	countArgs = append(append([]interface{}{}, baseArgs...), whereArgs...)
+	countQuery = fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS T%s", base, where)
+
+	orders := make([]string, 0, len(p.Sort)+1)
+	for _, s := range p.Sort {
+		if s.desc {
+			orders = append(orders, s.column+" DESC")
+		} else {
+			orders = append(orders, s.column)
+		}
+	}
+	if order != "" {
+		orders = append(orders, order)
+	}
+
+	query = fmt.Sprintf("SELECT * FROM (%s) AS T%s", base, where)
+	if len(orders) > 0 {
+		query += " ORDER BY " + strings.Join(orders, ", ")
+	}
+
+	limit := -1
+	if p.Limit > 0 {
+		limit = p.Limit
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(append([]interface{}{}, countArgs...), limit, p.Offset)
+	return
+}
+
+// Returns n comma separated placeholders, for use in an IN list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// How many values are put in one IN list, well under SQLite's limit on variables.
+const inListSize = 500
+
+// Calls fn with the items in chunks of at most inListSize, as query arguments.
+func eachInChunk[T any](items []T, fn func(args []interface{}) error) error {
+	for start := 0; start < len(items); start += inListSize {
+		end := start + inListSize
+		if end > len(items) {
+			end = len(items)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, item := range items[start:end] {
+			args = append(args, item)
+		}
+		err := fn(args)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts the rows of a base query matching the filters of the params, ignoring the page.
+func countList(spec ListSpec, p ListParams, base string, baseArgs ...interface{}) (total int, err error) {
+	_, _, countQuery, countArgs := p.build(base, baseArgs, spec.Order)
+	err = db.Get(&total, countQuery, countArgs...)
+	return
+}
+
+/*
+Entities with parts stored in other tables, filled in for a whole batch of rows
+at once rather than with a query per row.
+*/
+type listFiller[T any] interface {
+	fillList(items []T) error
+}
+
+/*
+Runs a base query with the filters, sort and page of the params applied,
+calling fn on each row as it is read. Only one row is held at a time, or one
+batch of streamFlushRows rows for entities implementing listFiller.
+*/
+func eachListRow[T any](spec ListSpec, p ListParams, fn func(T) error, base string, baseArgs ...interface{}) error {
+	query, args, _, _ := p.build(base, baseArgs, spec.Order)
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var zero T
+	filler, fills := any(zero).(listFiller[T])
+	batch := make([]T, 0)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := filler.fillList(batch)
+		if err != nil {
+			return err
+		}
+		for _, item := range batch {
+			err = fn(item)
+			if err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		var item T
+		err = rows.StructScan(&item)
+		if err != nil {
+			return err
+		}
+		if fills {
+			batch = append(batch, item)
+			if len(batch) == streamFlushRows {
+				err = flush()
+			}
+		} else {
+			err = fn(item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if fills {
+		return flush()
+	}
+	return nil
+}
+
+// Runs a base query with the filters, sort and page of the params applied.
+func queryList[T any](spec ListSpec, p ListParams, base string, baseArgs ...interface{}) (items []T, total int, err error) {
+	total, err = countList(spec, p, base, baseArgs...)
+	if err != nil {
+		return []T{}, 0, err
+	}
+
+	items = make([]T, 0)
+	err = eachListRow(spec, p, func(item T) error {
+		items = append(items, item)
+		return nil
+	}, base, baseArgs...)
+
+	return items, total, err
+}
+
+// How many rows are written between flushes of a streamed response.
+const streamFlushRows = 1000
+
+/*
+Streams a list row by row, as written by writeRow, after the prefix. Once the
+first row is written the status can no longer change, so errors past that point
+only end the stream.
+*/
+func streamList[T any](w http.ResponseWriter, spec ListSpec, p ListParams, noun string, contentType string, prefix string, writeRow func(T) error, base string, baseArgs ...interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprint(w, prefix)
+
+	flusher, canFlush := w.(http.Flusher)
+	written := 0
+	err := eachListRow(spec, p, func(item T) error {
+		err := writeRow(item)
+		if err != nil {
+			return err
+		}
+		written++
+		if canFlush && written%streamFlushRows == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}, base, baseArgs...)
+
+	if err != nil {
+		if written == 0 && prefix == "" {
+			writeError(w, err, fmt.Sprintf("Could not fetch %s.", noun))
+		} else {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+/*
+Writes a list to the response, taking limit, offset, sort and filters from the
+request. Noun is used in error messages, e.g. "Could not fetch Loci."
+*/
+func serveList[T any](w http.ResponseWriter, r *http.Request, spec ListSpec, noun string, base string, baseArgs ...interface{}) {
+	p, err := ParseListParams(r, spec)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+
+	format := negotiateFormat(r)
+	switch format {
+	case formatJSON:
+		// Written below, so errors can still be reported with a status.
+	case formatNDJSON:
+		encoder := json.NewEncoder(w)
+		streamList(w, spec, p, noun, formatMediaTypes[format], "", func(item T) error {
+			return encoder.Encode(&item)
+		}, base, baseArgs...)
+		return
+	default:
+		serveTabularList[T](w, spec, p, noun, format, base, baseArgs...)
+		return
+	}
+
+	items, total, err := queryList[T](spec, p, base, baseArgs...)
+	if err != nil {
+		writeError(w, err, fmt.Sprintf("Could not fetch %s.", noun))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	err = json.NewEncoder(w).Encode(&items)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+/*
+Writes a page of a list already held in memory, for lists which cannot be
+filtered in SQL. Only limit and offset of the parameters are applied.
+*/
+func servePage[T any](w http.ResponseWriter, p ListParams, items []T) {
+	total := len(items)
+	if p.Offset < len(items) {
+		items = items[p.Offset:]
+	} else {
+		items = items[:0]
+	}
+	if p.Limit > 0 && p.Limit < len(items) {
+		items = items[:p.Limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	err := json.NewEncoder(w).Encode(&items)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// Creates a handler listing every row of a base query, for lists with no parent resource.
+func handleListGeneric[T any](spec ListSpec, noun string, base string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveList[T](w, r, spec, noun, base)
+	}
+}
@@ -1,14 +1,14 @@
-// TODO: Implement automatic relationships of Genes and Loci upon creation or edit of Loci.
 package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
 type Locus struct {
@@ -16,24 +16,135 @@ type Locus struct {
 	Chr   string `json:"Chr" db:"Chr"`
 	Start int    `json:"Start" db:"Start"`
 	End   int    `json:"End" db:"End"`
+	Bin   int    `json:"-" db:"Bin"`
+}
+
+var locusList = ListSpec{
+	Fields: map[string]ListField{
+		"id":    {"ID", fieldString},
+		"chr":   {"Chr", fieldChr},
+		"start": {"Start", fieldInt},
+		"end":   {"End", fieldInt},
+	},
+	Order: "ID",
+}
+
+func (l Locus) Formats() []string {
+	return []string{formatBED, formatTSV}
+}
+
+func (l Locus) Header(format string) []string {
+	if format == formatTSV {
+		return []string{"ID", "Chr", "Start", "End"}
+	}
+	return nil
+}
+
+func (l Locus) Rows(format string) ([][]string, error) {
+	if format == formatTSV {
+		return [][]string{{l.ID, l.Chr, strconv.Itoa(l.Start), strconv.Itoa(l.End)}}, nil
+	}
+	return [][]string{{l.Chr, strconv.Itoa(l.Start), strconv.Itoa(l.End), l.ID}}, nil
 }
 
 func (l Locus) Save(oldId string) (err error) {
-	query := `UPDATE Loci SET ID=?, Chr=?, Start=?, End=? WHERE ID=?`
-	_, err = db.Exec(query, l.ID, l.Chr, l.Start, l.End, oldId)
-	return
+	// Genes of loci are part of the graphs of cell types.
+	defer invalidateGraphs()
+
+	l, err = l.Normalize()
+	if err != nil {
+		return
+	}
+
+	// Relations of the old ID are dropped, and rebuilt for the new coordinates,
+	// all or nothing so a failed update keeps them.
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM GeneInLocus WHERE Locus=?`, oldId)
+	if err != nil {
+		return
+	}
+
+	query := `UPDATE Loci SET ID=?, Chr=?, Start=?, End=?, Bin=? WHERE ID=?`
+	_, err = tx.Exec(query, l.ID, l.Chr, l.Start, l.End, binFromRange(l.Start, l.End), oldId)
+	if err != nil {
+		return
+	}
+
+	err = linkLocusToGenes(tx, l)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
 }
 
 func (l Locus) Create() (err error) {
-	query := `INSERT INTO Loci VALUES (?, ?, ?, ?)`
-	_, err = db.Exec(query, l.ID, l.Chr, l.Start, l.End)
-	return
+	l, err = l.Normalize()
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO Loci (ID, Chr, Start, End, Bin) VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, l.ID, l.Chr, l.Start, l.End, binFromRange(l.Start, l.End))
+	if err != nil {
+		return
+	}
+
+	err = linkLocusToGenes(tx, l)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+/*
+Creates an already normalized locus unless one with its ID exists. Only new
+loci are linked to genes, as existing ones already are.
+*/
+func createLocusIfMissing(ex sqlx.Execer, l Locus) error {
+	query := `INSERT OR IGNORE INTO Loci (ID, Chr, Start, End, Bin) VALUES (?, ?, ?, ?, ?)`
+	result, err := ex.Exec(query, l.ID, l.Chr, l.Start, l.End, binFromRange(l.Start, l.End))
+	if err != nil {
+		return dbError(err)
+	}
+
+	created, err := result.RowsAffected()
+	if err != nil || created == 0 {
+		return err
+	}
+	return linkLocusToGenes(ex, l)
 }
 
 func (l Locus) Delete() (err error) {
+	defer invalidateGraphs()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM GeneInLocus WHERE Locus=?`, l.ID)
+	if err != nil {
+		return
+	}
+
 	query := `DELETE FROM Loci WHERE ID=?`
-	_, err = db.Exec(query, l.ID)
-	return
+	_, err = tx.Exec(query, l.ID)
+	if err != nil {
+		return dbError(err)
+	}
+	return tx.Commit()
 }
 
 func GetLoci() ([]Locus, error) {
@@ -68,65 +179,47 @@ func GetLocus(ID string) (Locus, error) {
 		return l, nil
 	}
 
-	return Locus{}, errors.New("not_found")
+	return Locus{}, notFound("Locus")
 }
 
 func handleGetLoci(w http.ResponseWriter, r *http.Request) {
-	loci, err := GetLoci()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Loci.")
-		return
-	}
-
-	err = json.NewEncoder(w).Encode(loci)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Loci.")
-		return
-	}
+	serveList[Locus](w, r, locusList, "Loci", "SELECT * FROM Loci")
 }
 
 func handleGetLocus(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	locus, err := GetLocus(v["id"])
-	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Locus.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Loci.")
-		}
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci.")
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(locus)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Loci.")
+		writeError(w, err, "Could not fetch Loci.")
 	}
 }
 
 func handleDeleteLocus(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	locus, err := GetLocus(v["id"])
-	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Locus.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Loci.")
-		}
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci.")
 		return
 	}
 
 	err = locus.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Locus.")
+		writeError(w, err, "Could not delete Locus.")
 	}
 }
 
@@ -134,29 +227,58 @@ func handleCreateLoci(w http.ResponseWriter, r *http.Request) {
 	result := make([]Locus, 0)
 	err := json.NewDecoder(r.Body).Decode(&result)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body must be an array of Loci.")
+		writeBadRequest(w, "Request body must be an array of Loci.")
 		return
 	}
 
+	for i := 0; i < len(result); i++ {
+		result[i], err = result[i].Normalize()
+		if err != nil {
+			writeBadRequest(w, fmt.Sprintf("Invalid Locus at index %d: %s", i, err.Error()))
+			return
+		}
+	}
+
 	values := make([]string, len(result))
-	args := make([]interface{}, (len(result) * 4))
+	args := make([]interface{}, (len(result) * 5))
 	point := 0
 	for i := 0; i < len(result); i++ {
-		values[i] = "(?, ?, ?, ?)"
+		values[i] = "(?, ?, ?, ?, ?)"
 		args[point] = result[i].ID
 		args[point+1] = result[i].Chr
 		args[point+2] = result[i].Start
 		args[point+3] = result[i].End
-		point += 4
+		args[point+4] = binFromRange(result[i].Start, result[i].End)
+		point += 5
 	}
 
-	query := fmt.Sprintf("INSERT INTO Loci VALUES %s", strings.Join(values, ", "))
-	_, err = db.Exec(query, args...)
+	// The loci and their links to genes are created all or nothing.
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, err, "Could not create Loci.")
+		return
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("INSERT INTO Loci (ID, Chr, Start, End, Bin) VALUES %s", strings.Join(values, ", "))
+	_, err = tx.Exec(query, args...)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Could not create Loci.\n", err.Error())
+		writeError(w, err, "Could not create Loci.")
+		return
+	}
+
+	for _, l := range result {
+		err = linkLocusToGenes(tx, l)
+		if err != nil {
+			writeError(w, err, "Could not link the new Loci to Genes.")
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeError(w, err, "Could not create Loci.")
 		return
 	}
 
@@ -166,32 +288,47 @@ func handleCreateLoci(w http.ResponseWriter, r *http.Request) {
 
 func handleGetLocusGenes(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	locus, err := GetLocus(v["id"])
-	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Locus.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Loci.")
-		}
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci.")
 		return
 	}
 
-	genes, err := locus.GetGenes()
+	serveList[Gene](w, r, geneList, "Genes of Locus", locusGenesQuery, locus.ID)
+}
+
+// Filtering by cell type is the celltype filter of interactionList.
+func handleGetLocusInteractions(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Genes of Locus.")
+		writeError(w, err, "Could not fetch Loci.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(genes)
+	query := interactionsQuery("I.ID IN (SELECT Interaction FROM InteractionParticipation WHERE Locus=?)", "")
+	serveList[Interaction](w, r, interactionList, "Interactions of Locus", query, locus.ID)
 }
 
 func init() {
-	registerRoute(Route{"/loci", handleGetLoci, "GET"})
-	registerRoute(Route{"/loci/{id}", handleGetLocus, "GET"})
-	registerRoute(Route{"/loci/{id}", handleDeleteLocus, "DELETE"})
-	registerRoute(Route{"/loci", handleCreateLoci, "POST"})
-	registerRoute(Route{"/loci/{id}/genes", handleGetLocusGenes, "GET"})
+	registerRoute(Route{path: "/loci", handler: handleGetLoci, method: "GET",
+		summary: "List loci", response: []Locus{}, list: &locusList})
+	registerRoute(Route{path: "/loci/{id}", handler: handleGetLocus, method: "GET",
+		summary: "Get a locus", response: Locus{}})
+	registerRoute(Route{path: "/loci/{id}", handler: handleDeleteLocus, method: "DELETE",
+		summary: "Delete a locus"})
+	registerRoute(Route{path: "/loci", handler: handleCreateLoci, method: "POST",
+		summary: "Create loci", body: []Locus{}})
+	registerRoute(Route{path: "/loci/{id}/interactions", handler: handleGetLocusInteractions, method: "GET",
+		summary: "List the interactions a locus is an anchor of", response: []Interaction{}, list: &interactionList})
+	registerRoute(Route{path: "/loci/{id}/genes", handler: handleGetLocusGenes, method: "GET",
+		summary: "List the genes overlapping a locus", response: []Gene{}, list: &geneList})
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Contact matrices
+A region is cut into bins of a fixed resolution, the last bin being shorter
+when the region is not a multiple of it. Each anchor in the region falls in
+the bin of its midpoint, and each interaction counts once for every pair of
+its anchors in the region, so an interaction of n anchors adds n(n-1)/2
+contacts. Anchors outside of the region are left out. The matrix is
+symmetric, with contacts of two anchors in one bin on the diagonal.
+Matrices are returned in one of three layouts:
+  dense   JSON, with every count of the matrix in Counts.
+  sparse  JSON, with the non-zero counts of the upper triangle in Entries.
+  short   Juicebox "short with score" text, one line per non-zero count of the
+          upper triangle, as read by juicer_tools pre.
+**/
+
+// Larger matrices are only returned sparse, as a dense one would hold every cell.
+const maxDenseBins = 1000
+
+// The most bins a region may be cut into, to bound the memory of a request.
+const maxMatrixBins = 1000000
+
+const (
+	layoutDense  = "dense"
+	layoutSparse = "sparse"
+	layoutShort  = "short"
+)
+
+// A non-zero count of the upper triangle, with Row <= Column.
+type MatrixEntry struct {
+	Row    int `json:"Row"`
+	Column int `json:"Column"`
+	Count  int `json:"Count"`
+}
+
+type ContactMatrix struct {
+	CellType   string `json:"CellType"`
+	Region     Region `json:"Region"`
+	Resolution int    `json:"Resolution"`
+	// Number of rows and columns.
+	Bins   int    `json:"Bins"`
+	Layout string `json:"Layout"`
+	// Only the field of the layout is set, the other is null.
+	Counts  [][]int       `json:"Counts"`
+	Entries []MatrixEntry `json:"Entries"`
+}
+
+func matrixBins(region Region, resolution int) int {
+	return (region.End - region.Start + resolution - 1) / resolution
+}
+
+// A cell of the upper triangle of a contact matrix, with row <= column.
+type matrixCell struct{ row, column int }
+
+// Counts a contact for every pair of the bins of the anchors of one interaction.
+func countBinPairs(counts map[matrixCell]int, bins []int) {
+	for i, a := range bins {
+		for _, b := range bins[i+1:] {
+			row, column := a, b
+			if row > column {
+				row, column = column, row
+			}
+			counts[matrixCell{row, column}]++
+		}
+	}
+}
+
+/*
+Counts the contacts of the interactions of a cell type passing the filter
+within a region, as the non-zero cells of the upper triangle in row then
+column order. Only the attributes of the filter are used.
+*/
+func CountContacts(celltype string, region Region, resolution int, filter InteractionFilter) ([]MatrixEntry, error) {
+	clause, overlapArgs := overlapClause("L", "L.End", region.Chr, region.Start, region.End)
+	conditions, filterArgs := filter.attributeConditions("I.")
+	args := append([]interface{}{celltype}, filterArgs...)
+	query := `SELECT P.Interaction, L.* FROM InteractionParticipation AS P
+		INNER JOIN Interactions AS I ON I.ID=P.Interaction
+		INNER JOIN Loci AS L ON L.ID=P.Locus
+		WHERE ` + strings.Join(append([]string{"I.CellType=?"}, conditions...), " AND ") + ` AND ` + clause + ` ORDER BY P.Interaction`
+	rows, err := db.Queryx(query, append(args, overlapArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[matrixCell]int)
+
+	// Rows are ordered by interaction, so its anchors are counted once all are read.
+	current := int64(-1)
+	bins := make([]int, 0)
+	for rows.Next() {
+		var a anchorRow
+		err = rows.StructScan(&a)
+		if err != nil {
+			return nil, err
+		}
+		if a.Interaction != current {
+			countBinPairs(counts, bins)
+			current = a.Interaction
+			bins = bins[:0]
+		}
+
+		mid := (a.Start + a.End) / 2
+		if mid < region.Start || mid >= region.End {
+			continue
+		}
+		bins = append(bins, (mid-region.Start)/resolution)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	countBinPairs(counts, bins)
+
+	entries := make([]MatrixEntry, 0, len(counts))
+	for c, count := range counts {
+		entries = append(entries, MatrixEntry{c.row, c.column, count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Row != entries[j].Row {
+			return entries[i].Row < entries[j].Row
+		}
+		return entries[i].Column < entries[j].Column
+	})
+	return entries, nil
+}
+
+// Fills both triangles of a dense matrix from the entries of the upper one.
+func denseMatrix(entries []MatrixEntry, bins int) [][]int {
+	counts := make([][]int, bins)
+	for i := range counts {
+		counts[i] = make([]int, bins)
+	}
+	for _, e := range entries {
+		counts[e.Row][e.Column] = e.Count
+		counts[e.Column][e.Row] = e.Count
+	}
+	return counts
+}
+
+/*
+Writes the entries in the Juicebox short with score format. Both fragments are
+given as 0 and 1, as they only need to differ, and positions are bin starts.
+*/
+func writeShortMatrix(w http.ResponseWriter, m ContactMatrix, entries []MatrixEntry) error {
+	w.Header().Set("Content-Type", "text/plain")
+	out := bufio.NewWriter(w)
+	for _, e := range entries {
+		_, err := fmt.Fprintf(out, "0 %s %d 0 0 %s %d 1 %d\n", m.Region.Chr,
+			m.Region.Start+e.Row*m.Resolution, m.Region.Chr, m.Region.Start+e.Column*m.Resolution, e.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+/** HTTP Routes **/
+
+func handleGetContactMatrix(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	q := r.URL.Query()
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+
+	if q.Get("region") == "" {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "region must be given, such as chrX:0-1000000.")
+		return
+	}
+	region, err := ParseRegion(q.Get("region"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_region", err.Error())
+		return
+	}
+
+	resolution, err := strconv.Atoi(q.Get("resolution"))
+	if err != nil || resolution < 1 {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "resolution must be a positive integer.")
+		return
+	}
+	bins := matrixBins(region, resolution)
+	if bins > maxMatrixBins {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("The region would be cut into %d bins, more than %d.", bins, maxMatrixBins))
+		return
+	}
+
+	// Without a layout the matrix is dense when small enough. The short layout
+	// can also be asked for as format=short.
+	layout := q.Get("layout")
+	if negotiateFormat(r) == layoutShort {
+		layout = layoutShort
+	}
+	switch layout {
+	case "":
+		layout = layoutDense
+		if bins > maxDenseBins {
+			layout = layoutSparse
+		}
+	case layoutDense:
+		if bins > maxDenseBins {
+			writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("Dense matrices have at most %d bins, use the sparse layout or a coarser resolution.", maxDenseBins))
+			return
+		}
+	case layoutSparse, layoutShort:
+	default:
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "layout must be dense, sparse or short.")
+		return
+	}
+
+	filter, err := parseInteractionFilter(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	entries, err := CountContacts(cell.Type, region, resolution, filter)
+	if err != nil {
+		writeError(w, err, "Could not count contacts.")
+		return
+	}
+
+	m := ContactMatrix{CellType: cell.Type, Region: region, Resolution: resolution, Bins: bins, Layout: layout}
+	switch layout {
+	case layoutShort:
+		err = writeShortMatrix(w, m, entries)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	case layoutDense:
+		m.Counts = denseMatrix(entries, bins)
+	case layoutSparse:
+		m.Entries = entries
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func init() {
+	registerRoute(Route{path: "/celltypes/{type}/matrix", handler: handleGetContactMatrix, method: "GET",
+		summary:  "Bin the interactions of a cell type within a region into a contact matrix",
+		response: ContactMatrix{}, query: append([]string{"region", "resolution", "layout", "format"}, interactionFilterParams...)})
+}
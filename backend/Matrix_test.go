@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountBinPairs(t *testing.T) {
+	tests := []struct {
+		name string
+		bins []int
+		want map[matrixCell]int
+	}{
+		{"no anchors", nil, map[matrixCell]int{}},
+		{"one anchor", []int{3}, map[matrixCell]int{}},
+		{"sorted pair", []int{1, 4}, map[matrixCell]int{{1, 4}: 1}},
+		{"unsorted pair", []int{4, 1}, map[matrixCell]int{{1, 4}: 1}},
+		{"same bin", []int{2, 2}, map[matrixCell]int{{2, 2}: 1}},
+		{"unsorted three anchors", []int{5, 2, 7}, map[matrixCell]int{{2, 5}: 1, {2, 7}: 1, {5, 7}: 1}},
+		{"descending four anchors", []int{9, 6, 3, 0}, map[matrixCell]int{
+			{6, 9}: 1, {3, 9}: 1, {0, 9}: 1, {3, 6}: 1, {0, 6}: 1, {0, 3}: 1,
+		}},
+		{"repeated bins", []int{3, 1, 3}, map[matrixCell]int{{1, 3}: 2, {3, 3}: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := make(map[matrixCell]int)
+			countBinPairs(counts, tt.bins)
+			if !reflect.DeepEqual(counts, tt.want) {
+				t.Errorf("countBinPairs(%v) = %v, want %v", tt.bins, counts, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountBinPairsAccumulates(t *testing.T) {
+	counts := make(map[matrixCell]int)
+	countBinPairs(counts, []int{7, 2})
+	countBinPairs(counts, []int{2, 7, 4})
+	want := map[matrixCell]int{{2, 7}: 2, {2, 4}: 1, {4, 7}: 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/**
+Migrations
+Bring databases created from an older sql/schema.sql up to date. Each migration
+checks whether it is still needed, so running them again does nothing.
+Run them with the RUN_MIGRATIONS command after updating the backend.
+**/
+
+type Migration struct {
+	name string
+	// Whether the database still needs the migration.
+	needed func() (bool, error)
+	apply  func(tx *sqlx.Tx) error
+}
+
+var migrations = make([]Migration, 0)
+
+func registerMigration(m Migration) {
+	migrations = append(migrations, m)
+}
+
+// Applies every migration the database needs, each in its own transaction.
+func RunMigrations() error {
+	for _, m := range migrations {
+		needed, err := m.needed()
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		if !needed {
+			continue
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		err = m.apply(tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[Info] Applied migration: %s.\n", m.name)
+	}
+
+	return nil
+}
+
+// A migration adding a column to a table which lacks it.
+func addColumnMigration(table string, column string, definition string) Migration {
+	return Migration{
+		name: fmt.Sprintf("add %s.%s", table, column),
+		needed: func() (bool, error) {
+			exists, err := tableHasColumn(table, column)
+			return !exists, err
+		},
+		apply: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+			return err
+		},
+	}
+}
+
+func tableExists(name string) (exists bool, err error) {
+	err = db.Get(&exists, `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name=?`, name)
+	return
+}
+
+// A migration creating a table added to sql/schema.sql, given as its CREATE TABLE statement.
+func createTableMigration(table string, definition string) Migration {
+	return Migration{
+		name: fmt.Sprintf("create %s", table),
+		needed: func() (bool, error) {
+			exists, err := tableExists(table)
+			return !exists, err
+		},
+		apply: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(definition)
+			return err
+		},
+	}
+}
+
+func init() {
+	registerCommand(Command{"RUN_MIGRATIONS", func() {
+		err := RunMigrations()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}})
+}
@@ -2,20 +2,81 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// Motif instances joined with the length of their model, for formats needing their end.
+const motifInstanceWithLengthQuery = `SELECT MI.*, MM.Length AS Length FROM MotifInstances AS MI INNER JOIN MotifModels AS MM ON MI.Model=MM.Name`
+
 type MotifInstance struct {
 	CellType       string  `json:"CellType" db:"CellType"`
 	Chr            string  `json:"Chr" db:"Chr"`
 	Start          int     `json:"Start" db:"Start"`
-	Forward        bool    `json:"Forward" db:"End"`
+	Forward        bool    `json:"Forward" db:"Forward"`
 	ThresholdScore float64 `json:"ThresholdScore" db:"ThresholdScore"`
 	LocusID        string  `json:"LocusID" db:"LocusID"`
 	Model          string  `json:"Model" db:"Model"`
+	Bin            int     `json:"-" db:"Bin"`
+	// Length of the model, only filled by queries which join MotifModels.
+	Length int `json:"-" db:"Length"`
+}
+
+var motifInstanceList = ListSpec{
+	Fields: map[string]ListField{
+		"celltype": {"CellType", fieldString},
+		"chr":      {"Chr", fieldChr},
+		"start":    {"Start", fieldInt},
+		"forward":  {"Forward", fieldBool},
+		"score":    {"ThresholdScore", fieldFloat},
+		"locusid":  {"LocusID", fieldString},
+		"model":    {"Model", fieldString},
+	},
+	Order: "CellType, Chr, Start",
+}
+
+/*
+BED scores are integers from 0 to 1000. Threshold scores are log-odds in bits,
+rarely past 40 even for long motifs, so they are scaled by 25 and clamped.
+*/
+const bedScorePerBit = 25
+
+func bedScore(thresholdScore float64) string {
+	score := math.Round(thresholdScore * bedScorePerBit)
+	if score < 0 {
+		score = 0
+	} else if score > 1000 {
+		score = 1000
+	}
+	return strconv.Itoa(int(score))
+}
+
+func (m MotifInstance) Formats() []string {
+	return []string{formatBED, formatTSV}
+}
+
+func (m MotifInstance) Header(format string) []string {
+	if format == formatTSV {
+		return []string{"CellType", "Chr", "Start", "End", "Forward", "ThresholdScore", "LocusID", "Model"}
+	}
+	return nil
+}
+
+func (m MotifInstance) Rows(format string) ([][]string, error) {
+	if m.Length == 0 {
+		return nil, fmt.Errorf("length of motif model %s was not loaded", m.Model)
+	}
+	start := strconv.Itoa(m.Start)
+	end := strconv.Itoa(m.Start + m.Length)
+
+	if format == formatTSV {
+		score := strconv.FormatFloat(m.ThresholdScore, 'g', -1, 64)
+		return [][]string{{m.CellType, m.Chr, start, end, strconv.FormatBool(m.Forward), score, m.LocusID, m.Model}}, nil
+	}
+	return [][]string{{m.Chr, start, end, m.Model, bedScore(m.ThresholdScore), strandOf(m.Forward)}}, nil
 }
 
 func (m MotifInstance) GetModel() (model MotifModel, err error) {
@@ -23,18 +84,51 @@ func (m MotifInstance) GetModel() (model MotifModel, err error) {
 	return
 }
 
-func (m MotifInstance) Create() (err error) {
-	query := `INSERT INTO MotifInstances VALUES (?, ?, ?, ?, ?, ?, ?)`
-	_, err = db.Exec(query, m.CellType, m.Chr, m.Start, m.Forward, m.ThresholdScore, m.LocusID, m.Model)
+// Instances span the length of their model, so the model is needed to index them.
+func motifModelLengths() (lengths map[string]int, err error) {
+	lengths = make(map[string]int)
+	rows, err := db.Queryx("SELECT Name, Length FROM MotifModels")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var length int
+		err = rows.Scan(&name, &length)
+		if err != nil {
+			return
+		}
+		lengths[name] = length
+	}
+
 	return
 }
 
+func (m MotifInstance) Create() (err error) {
+	model, err := GetMotifModel(m.Model)
+	if err != nil {
+		return
+	}
+	r, err := NewRegion(m.Chr, m.Start, m.Start+model.Length)
+	if err != nil {
+		return
+	}
+	m.Chr = r.Chr
+
+	query := `INSERT INTO MotifInstances (CellType, Chr, Start, Forward, ThresholdScore, LocusID, Model, Bin) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, m.CellType, m.Chr, m.Start, m.Forward, m.ThresholdScore, m.LocusID, m.Model, binFromRange(m.Start, m.Start+model.Length))
+	return dbError(err)
+}
+
 func (m MotifModel) GetInstances() (instances []MotifInstance, err error) {
-	query := "SELECT * FROM MotifInstance WHERE Model=?"
+	query := "SELECT * FROM MotifInstances WHERE Model=?"
 	rows, err := db.Queryx(query, m.Name)
 	if err != nil {
 		return []MotifInstance{}, err
 	}
+	defer rows.Close()
 
 	instances = make([]MotifInstance, 0)
 	for rows.Next() {
@@ -47,7 +141,7 @@ func (m MotifModel) GetInstances() (instances []MotifInstance, err error) {
 }
 
 func (c CellType) GetMotifInstances() (instances []MotifInstance, err error) {
-	query := "SELECT * FROM MotifInstance WHERE CellType=?"
+	query := "SELECT * FROM MotifInstances WHERE CellType=?"
 	rows, err := db.Queryx(query, c.Type)
 
 	if err != nil {
@@ -66,29 +160,43 @@ func (c CellType) GetMotifInstances() (instances []MotifInstance, err error) {
 }
 
 func CreateMotifInstances(instances []MotifInstance) (err error) {
+	lengths, err := motifModelLengths()
+	if err != nil {
+		return
+	}
+
 	values := make([]string, len(instances))
-	args := make([]interface{}, (len(instances) * 7))
+	args := make([]interface{}, (len(instances) * 8))
 	point := 0
 	for i := 0; i < len(instances); i++ {
-		values[i] = "(?, ?, ?, ?, ?, ?, ?)"
+		length, ok := lengths[instances[i].Model]
+		if !ok {
+			return DataError{ErrForeignKey, fmt.Sprintf("Motif Instance %d references Motif Model %s, which does not exist.", i, instances[i].Model)}
+		}
+		r, err := NewRegion(instances[i].Chr, instances[i].Start, instances[i].Start+length)
+		if err != nil {
+			return err
+		}
+
+		values[i] = "(?, ?, ?, ?, ?, ?, ?, ?)"
 		args[point] = instances[i].CellType
-		args[point+1] = instances[i].Chr
+		args[point+1] = r.Chr
 		args[point+2] = instances[i].Start
 		args[point+3] = instances[i].Forward
 		args[point+4] = instances[i].ThresholdScore
 		args[point+5] = instances[i].LocusID
 		args[point+6] = instances[i].Model
-		point += 7
+		args[point+7] = binFromRange(instances[i].Start, instances[i].Start+length)
+		point += 8
 	}
 
-	query := fmt.Sprintf("INSERT INTO MotifInstances VALUES %s", strings.Join(values, ", "))
+	query := fmt.Sprintf("INSERT INTO MotifInstances (CellType, Chr, Start, Forward, ThresholdScore, LocusID, Model, Bin) VALUES %s", strings.Join(values, ", "))
 	_, err = db.Exec(query, args...)
-
-	return
+	return dbError(err)
 }
 
 func GetMotifInstance(celltype string, chr string, start int) (instance MotifInstance, err error) {
-	query := "SELECT * FROM MotifInstance WHERE CellType=? AND Chr=? AND Start=?"
+	query := "SELECT * FROM MotifInstances WHERE CellType=? AND Chr=? AND Start=?"
 	rows, err := db.Queryx(query, celltype, chr, start)
 	if err != nil {
 		return MotifInstance{}, err
@@ -100,29 +208,37 @@ func GetMotifInstance(celltype string, chr string, start int) (instance MotifIns
 		return
 	}
 
-	return MotifInstance{}, errors.New("not_found")
+	return MotifInstance{}, notFound("Motif Instance")
 }
 
 func (m MotifInstance) Delete() (err error) {
-	query := "DELETE FROM MotifModels WHERE CellType=? AND Chr=? AND Start=?"
+	query := "DELETE FROM MotifInstances WHERE CellType=? AND Chr=? AND Start=?"
 	_, err = db.Exec(query, m.CellType, m.Chr, m.Start)
-	return
+	return dbError(err)
 }
 
 func handleCreateMotifInstance(w http.ResponseWriter, r *http.Request) {
 	instances := make([]MotifInstance, 0)
 	err := json.NewDecoder(r.Body).Decode(&instances)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body should be an array of Motif Instances")
+		writeBadRequest(w, "Request body should be an array of Motif Instances")
 		return
 	}
 
+	for i := 0; i < len(instances); i++ {
+		locus, err := ParseRegion(instances[i].LocusID)
+		if err != nil {
+			writeBadRequest(w, fmt.Sprintf("Invalid Locus ID of Motif Instance at index %d: %s", i, err.Error()))
+			return
+		}
+		instances[i].LocusID = locus.ID()
+		instances[i].Chr = normalizeChrName(instances[i].Chr)
+	}
+
 	err = CreateMotifInstances(instances)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not create Motif Instances.")
+		writeError(w, err, "Could not create Motif Instances.")
 		return
 	}
 
@@ -131,6 +247,7 @@ func handleCreateMotifInstance(w http.ResponseWriter, r *http.Request) {
 }
 
 func init() {
-	registerRoute(Route{"/motifinstances", handleCreateMotifInstance, "POST"})
+	registerRoute(Route{path: "/motifinstances", handler: handleCreateMotifInstance, method: "POST",
+		summary: "Create motif instances", body: []MotifInstance{}})
 	// Need to figure out how to implement edits.
 }
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestMotifInstanceBEDScore(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  string
+	}{
+		{0, "0"},
+		{11, "275"},
+		{11.49, "287"},
+		{-3.2, "0"},
+		{40, "1000"},
+		{57.5, "1000"},
+	}
+	for _, tt := range tests {
+		m := MotifInstance{Chr: "chrX", Start: 100, Length: 9, Forward: false, ThresholdScore: tt.score, Model: "PBX1"}
+		rows, err := m.Rows(formatBED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"chrX", "100", "109", "PBX1", tt.want, "-"}
+		if len(rows) != 1 || len(rows[0]) != len(want) {
+			t.Fatalf("Rows = %v, want [%v]", rows, want)
+		}
+		for i := range want {
+			if rows[0][i] != want[i] {
+				t.Errorf("score %v: Rows = %v, want [%v]", tt.score, rows[0], want)
+				break
+			}
+		}
+	}
+}
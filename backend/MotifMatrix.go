@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Motif matrices
+A Motif Model may have a matrix of each kind, with one row per position of the
+motif holding the values of A, C, G and T:
+  pcm  Position count matrix, the number of sites with each base.
+  pfm  Position frequency matrix, each row summing to 1.
+  pwm  Position weight matrix, log-odds scores against a background.
+Every matrix is as wide as the Length of its model. When not stored, a
+frequency matrix is derived from the counts, and a weight matrix from the
+frequencies against a uniform background.
+Matrices are read from and written in the formats of MotifMatrixFormats.go.
+**/
+
+const (
+	matrixCounts      = "pcm"
+	matrixFrequencies = "pfm"
+	matrixWeights     = "pwm"
+)
+
+// Kinds in the order one is picked when a request names none.
+var matrixKinds = []string{matrixCounts, matrixFrequencies, matrixWeights}
+
+// How far the rows of a frequency matrix may sum from 1, as files round their values.
+const frequencyTolerance = 0.02
+
+// Added to every frequency when deriving weights.
+const weightPseudocount = 0.01
+
+type MotifMatrix struct {
+	Model string `json:"Model"`
+	Kind  string `json:"Kind"`
+	// Whether the matrix was derived from another kind instead of stored.
+	Derived bool `json:"Derived"`
+	// One row per position, of the values of A, C, G and T.
+	Rows [][4]float64 `json:"Rows"`
+}
+
+// A stored row of a matrix.
+type matrixRow struct {
+	Model    string  `db:"Model"`
+	Kind     string  `db:"Kind"`
+	Position int     `db:"Position"`
+	A        float64 `db:"A"`
+	C        float64 `db:"C"`
+	G        float64 `db:"G"`
+	T        float64 `db:"T"`
+}
+
+func isMatrixKind(kind string) bool {
+	for _, k := range matrixKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MotifMatrix) Width() int {
+	return len(m.Rows)
+}
+
+// Checks the matrix against the Length of its model and the range of its kind.
+func (m MotifMatrix) validate(mm MotifModel) error {
+	if !isMatrixKind(m.Kind) {
+		return invalid("Kind must be one of %s.", strings.Join(matrixKinds, ", "))
+	}
+	if m.Width() != mm.Length {
+		return invalid("The matrix has width %d, but Motif Model %s has Length %d.", m.Width(), mm.Name, mm.Length)
+	}
+
+	for i, row := range m.Rows {
+		sum := 0.0
+		for _, value := range row {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return invalid("Position %d of the matrix is not a number.", i)
+			}
+			if value < 0 && m.Kind != matrixWeights {
+				return invalid("Position %d of the matrix has a negative value, which only a pwm may have.", i)
+			}
+			sum += value
+		}
+		switch {
+		case m.Kind == matrixCounts && sum == 0:
+			return invalid("Position %d of the matrix has no counts.", i)
+		case m.Kind == matrixFrequencies && math.Abs(sum-1) > frequencyTolerance:
+			return invalid("Position %d of the matrix sums to %g instead of 1.", i, sum)
+		}
+	}
+	return nil
+}
+
+// The frequencies of a count matrix, each position divided by its total.
+func (m MotifMatrix) frequencies() MotifMatrix {
+	f := MotifMatrix{Model: m.Model, Kind: matrixFrequencies, Derived: true, Rows: make([][4]float64, len(m.Rows))}
+	for i, row := range m.Rows {
+		sum := row[0] + row[1] + row[2] + row[3]
+		for j, value := range row {
+			f.Rows[i][j] = value / sum
+		}
+	}
+	return f
+}
+
+/*
+The log2 odds of the frequencies of a frequency matrix against a uniform
+background, with a small pseudocount so absent bases score low rather than
+-Inf.
+*/
+func (m MotifMatrix) weights() MotifMatrix {
+	pw := MotifMatrix{Model: m.Model, Kind: matrixWeights, Derived: true, Rows: make([][4]float64, len(m.Rows))}
+	for i, row := range m.Rows {
+		for j, value := range row {
+			pw.Rows[i][j] = math.Log2((value + weightPseudocount) / (1 + 4*weightPseudocount) / 0.25)
+		}
+	}
+	return pw
+}
+
+// The number of sites a count matrix was built from, the largest total of its positions.
+func (m MotifMatrix) sites() int {
+	sites := 0.0
+	for _, row := range m.Rows {
+		sites = math.Max(sites, row[0]+row[1]+row[2]+row[3])
+	}
+	return int(math.Round(sites))
+}
+
+/*
+Stores the matrix, replacing the one of the same kind of its model. Fails with
+a validation error if its width is not the Length of the model.
+*/
+func (m MotifMatrix) Save() error {
+	mm, err := GetMotifModel(m.Model)
+	if err != nil {
+		return err
+	}
+	err = m.validate(mm)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM MotifMatrices WHERE Model=? AND Kind=?", m.Model, m.Kind)
+	if err != nil {
+		return dbError(err)
+	}
+	for i, row := range m.Rows {
+		_, err = tx.Exec("INSERT INTO MotifMatrices (Model, Kind, Position, A, C, G, T) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			m.Model, m.Kind, i, row[0], row[1], row[2], row[3])
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the stored matrices of a model, by kind.
+func GetMotifMatrices(model string) (map[string]MotifMatrix, error) {
+	rows, err := db.Queryx("SELECT * FROM MotifMatrices WHERE Model=? ORDER BY Kind, Position", model)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matrices := make(map[string]MotifMatrix)
+	for rows.Next() {
+		var row matrixRow
+		err = rows.StructScan(&row)
+		if err != nil {
+			return nil, err
+		}
+		m, seen := matrices[row.Kind]
+		if !seen {
+			m = MotifMatrix{Model: row.Model, Kind: row.Kind, Rows: make([][4]float64, 0)}
+		}
+		m.Rows = append(m.Rows, [4]float64{row.A, row.C, row.G, row.T})
+		matrices[row.Kind] = m
+	}
+	return matrices, rows.Err()
+}
+
+/*
+Returns the matrix of a kind of a model, deriving it from the others when it
+is not stored. Without a kind the first stored one of matrixKinds is returned.
+*/
+func GetMotifMatrix(model string, kind string) (MotifMatrix, error) {
+	matrices, err := GetMotifMatrices(model)
+	if err != nil {
+		return MotifMatrix{}, err
+	}
+
+	if kind == "" {
+		for _, k := range matrixKinds {
+			if m, ok := matrices[k]; ok {
+				return m, nil
+			}
+		}
+		return MotifMatrix{}, notFound("Motif Matrix")
+	}
+	if m, ok := matrices[kind]; ok {
+		return m, nil
+	}
+
+	frequencies, ok := matrices[matrixFrequencies]
+	if counts, hasCounts := matrices[matrixCounts]; !ok && hasCounts {
+		frequencies, ok = counts.frequencies(), true
+	}
+	switch {
+	case ok && kind == matrixFrequencies:
+		return frequencies, nil
+	case ok && kind == matrixWeights:
+		return frequencies.weights(), nil
+	}
+	return MotifMatrix{}, notFound("Motif Matrix")
+}
+
+// Deletes the matrix of a kind of a model, or all of them without a kind.
+func DeleteMotifMatrices(model string, kind string) error {
+	query := "DELETE FROM MotifMatrices WHERE Model=?"
+	args := []interface{}{model}
+	if kind != "" {
+		query += " AND Kind=?"
+		args = append(args, kind)
+	}
+	_, err := db.Exec(query, args...)
+	return dbError(err)
+}
+
+/** HTTP Routes **/
+
+func parseMatrixKind(r *http.Request) (string, error) {
+	kind := strings.ToLower(r.URL.Query().Get("kind"))
+	if kind != "" && !isMatrixKind(kind) {
+		return "", fmt.Errorf("kind must be one of %s", strings.Join(matrixKinds, ", "))
+	}
+	return kind, nil
+}
+
+func handleGetMotifMatrix(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	mm, err := GetMotifModel(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Models.")
+		return
+	}
+	kind, err := parseMatrixKind(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	format := negotiateFormat(r)
+	if format != formatJSON && !isMatrixFormat(format) {
+		writeProblem(w, http.StatusNotAcceptable, "not_acceptable", fmt.Sprintf("Motif Matrices cannot be returned as %s.", format))
+		return
+	}
+	m, err := GetMotifMatrix(mm.Name, kind)
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Matrices.")
+		return
+	}
+
+	if format == formatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	err = writeMotifMatrix(w, format, mm, m)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+/*
+Stores a matrix of the model, given as JSON or, with the format parameter, as
+the text of a matrix file. A file may hold several motifs, of which those named
+after the model are kept, unless it holds a single one.
+*/
+func handlePutMotifMatrix(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	mm, err := GetMotifModel(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Models.")
+		return
+	}
+	kind, err := parseMatrixKind(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	matrices := make([]MotifMatrix, 0)
+	switch {
+	case format == "" || format == formatJSON:
+		var m MotifMatrix
+		err = json.NewDecoder(r.Body).Decode(&m)
+		if err != nil {
+			writeBadRequest(w, "Request body should be a Motif Matrix.")
+			return
+		}
+		if m.Kind == "" {
+			m.Kind = kind
+		}
+		matrices = append(matrices, m)
+	case isMatrixFormat(format):
+		text, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBadRequest(w, "Could not read the request body.")
+			return
+		}
+		motifs, err := ParseMotifMatrices(format, kind, string(text))
+		if err != nil {
+			writeBadRequest(w, err.Error())
+			return
+		}
+		for _, motif := range motifs {
+			if len(motifs) == 1 || motif.named(mm.Name) {
+				matrices = append(matrices, motif.Matrices...)
+			}
+		}
+		if len(matrices) == 0 {
+			writeBadRequest(w, fmt.Sprintf("The file holds no motif named %s.", mm.Name))
+			return
+		}
+	default:
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "format must be json, "+strings.Join(matrixFormats, ", ")+".")
+		return
+	}
+
+	for _, m := range matrices {
+		m.Model = mm.Name
+		err = m.Save()
+		if err != nil {
+			writeError(w, err, "Could not store Motif Matrix.")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleDeleteMotifMatrix(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	mm, err := GetMotifModel(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Models.")
+		return
+	}
+	kind, err := parseMatrixKind(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	err = DeleteMotifMatrices(mm.Name, kind)
+	if err != nil {
+		writeError(w, err, "Could not delete Motif Matrices.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func init() {
+	registerMigration(createTableMigration("MotifMatrices", `CREATE TABLE MotifMatrices (
+		Model varchar(255) NOT NULL,
+		Kind varchar(3) NOT NULL,
+		Position INT NOT NULL,
+		A FLOAT NOT NULL,
+		C FLOAT NOT NULL,
+		G FLOAT NOT NULL,
+		T FLOAT NOT NULL,
+		PRIMARY KEY (Model, Kind, Position),
+		FOREIGN KEY (Model) REFERENCES MotifModels(Name),
+		CHECK (Kind IN ('pcm', 'pfm', 'pwm')),
+		CHECK (Position >= 0)
+	)`))
+
+	registerRoute(Route{path: "/motifmodels/{name}/matrix", handler: handleGetMotifMatrix, method: "GET",
+		summary:  "Get a matrix of a motif model, as JSON or in the HOCOMOCO, JASPAR or MEME format",
+		response: MotifMatrix{}, query: []string{"kind", "format"}})
+	registerRoute(Route{path: "/motifmodels/{name}/matrix", handler: handlePutMotifMatrix, method: "PUT",
+		summary: "Store a matrix of a motif model, given as JSON or in the HOCOMOCO, JASPAR or MEME format",
+		body:    MotifMatrix{}, query: []string{"kind", "format"}})
+	registerRoute(Route{path: "/motifmodels/{name}/matrix", handler: handleDeleteMotifMatrix, method: "DELETE",
+		summary: "Delete the matrix of a kind of a motif model, or all of them", query: []string{"kind"}})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+Motif matrix formats
+Matrices are read from and written as the text files of the main motif
+collections. Each file may hold several motifs.
+  hocomoco  A ">name" line, then one line per position of the four values of
+            A, C, G and T, as in the .pcm and .pwm files of HOCOMOCO. The kind
+            is not written in the file, so it comes from the file extension or
+            the kind parameter, or is guessed from the values.
+  jaspar    A ">ID name" line, then one line per base, such as "A [ 3 0 12 ]",
+            as in JASPAR. The base letters and brackets may be left out, with
+            the lines in the order A, C, G, T. JASPAR matrices hold counts.
+  meme      The MEME motif format: "MOTIF ID name" lines, each followed by a
+            "letter-probability matrix:" of frequencies, a "log-odds matrix:"
+            of weights, or both.
+**/
+
+const (
+	formatHOCOMOCO = "hocomoco"
+	formatJASPAR   = "jaspar"
+	formatMEME     = "meme"
+)
+
+var matrixFormats = []string{formatHOCOMOCO, formatJASPAR, formatMEME}
+
+const matrixBases = "ACGT"
+
+func isMatrixFormat(format string) bool {
+	for _, f := range matrixFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// A motif read from a file, with the names it was given there and its matrices.
+type ParsedMotif struct {
+	Names    []string
+	Matrices []MotifMatrix
+}
+
+func (p ParsedMotif) named(name string) bool {
+	for _, n := range p.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Reads the motifs of a matrix file. The kind applies to every matrix of a
+HOCOMOCO or JASPAR file, and is guessed from the values when empty. Matrices
+are left without a Model, as the names of a file may not be those of the
+database.
+*/
+func ParseMotifMatrices(format string, kind string, text string) ([]ParsedMotif, error) {
+	var motifs []ParsedMotif
+	var err error
+	switch format {
+	case formatHOCOMOCO:
+		motifs, err = parseHOCOMOCO(text)
+	case formatJASPAR:
+		motifs, err = parseJASPAR(text)
+	case formatMEME:
+		return parseMEME(text)
+	default:
+		return nil, fmt.Errorf("unknown matrix format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, motif := range motifs {
+		for i := range motif.Matrices {
+			motif.Matrices[i].Kind = kind
+			if kind == "" {
+				motif.Matrices[i].Kind = guessMatrixKind(motif.Matrices[i].Rows)
+			}
+		}
+	}
+	return motifs, nil
+}
+
+// Weights are the only values which may be negative, and frequencies sum to 1.
+func guessMatrixKind(rows [][4]float64) string {
+	kind := matrixFrequencies
+	for _, row := range rows {
+		sum := 0.0
+		for _, value := range row {
+			if value < 0 {
+				return matrixWeights
+			}
+			sum += value
+		}
+		if math.Abs(sum-1) > frequencyTolerance {
+			kind = matrixCounts
+		}
+	}
+	return kind
+}
+
+// Parses the fields of a line as numbers, or ok false if any is not one.
+func parseMatrixValues(fields []string) (values []float64, ok bool) {
+	values = make([]float64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, false
+		}
+		values[i] = value
+	}
+	return values, true
+}
+
+// The non-empty lines of a file, trimmed, leaving out # comments.
+func matrixLines(text string) []string {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseHOCOMOCO(text string) ([]ParsedMotif, error) {
+	motifs := make([]ParsedMotif, 0)
+	for n, line := range matrixLines(text) {
+		if strings.HasPrefix(line, ">") {
+			// HOCOMOCO names hold no spaces, anything after the first field is a comment.
+			names := strings.Fields(line[1:])
+			if len(names) > 1 {
+				names = names[:1]
+			}
+			motifs = append(motifs, ParsedMotif{Names: names, Matrices: []MotifMatrix{{Rows: make([][4]float64, 0)}}})
+			continue
+		}
+
+		values, ok := parseMatrixValues(strings.Fields(line))
+		if !ok || len(values) != 4 {
+			return nil, fmt.Errorf("line %d should be the 4 values of a position", n+1)
+		}
+		// Files of a single motif may leave out its name.
+		if len(motifs) == 0 {
+			motifs = append(motifs, ParsedMotif{Names: []string{}, Matrices: []MotifMatrix{{Rows: make([][4]float64, 0)}}})
+		}
+		m := &motifs[len(motifs)-1].Matrices[0]
+		m.Rows = append(m.Rows, [4]float64{values[0], values[1], values[2], values[3]})
+	}
+	return motifs, nil
+}
+
+func parseJASPAR(text string) ([]ParsedMotif, error) {
+	motifs := make([]ParsedMotif, 0)
+	// The rows of the motif being read, by base, filled in order when unlabelled.
+	var bases [4][]float64
+	read := 0
+
+	finish := func() error {
+		if read == 0 {
+			return nil
+		}
+		if read != 4 {
+			return fmt.Errorf("motif %d has %d base lines instead of 4", len(motifs), read)
+		}
+		for _, values := range bases {
+			if len(values) != len(bases[0]) {
+				return fmt.Errorf("the base lines of motif %d have different lengths", len(motifs))
+			}
+		}
+		m := MotifMatrix{Rows: make([][4]float64, len(bases[0]))}
+		for b, values := range bases {
+			for i, value := range values {
+				m.Rows[i][b] = value
+			}
+		}
+		motifs[len(motifs)-1].Matrices = []MotifMatrix{m}
+		bases = [4][]float64{}
+		read = 0
+		return nil
+	}
+
+	for n, line := range matrixLines(text) {
+		if strings.HasPrefix(line, ">") {
+			err := finish()
+			if err != nil {
+				return nil, err
+			}
+			motifs = append(motifs, ParsedMotif{Names: strings.Fields(line[1:])})
+			continue
+		}
+
+		fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(line))
+		b := read
+		if len(fields) > 0 && len(fields[0]) == 1 && strings.Contains(matrixBases, strings.ToUpper(fields[0])) {
+			b = strings.Index(matrixBases, strings.ToUpper(fields[0]))
+			fields = fields[1:]
+		}
+		values, ok := parseMatrixValues(fields)
+		if !ok || len(values) == 0 || read >= 4 || bases[b] != nil {
+			return nil, fmt.Errorf("line %d should be the values of one more base", n+1)
+		}
+		if len(motifs) == 0 {
+			motifs = append(motifs, ParsedMotif{Names: []string{}})
+		}
+		bases[b] = values
+		read++
+	}
+
+	err := finish()
+	if err != nil {
+		return nil, err
+	}
+	for i, motif := range motifs {
+		if len(motif.Matrices) == 0 {
+			return nil, fmt.Errorf("motif %d has no matrix", i+1)
+		}
+	}
+	return motifs, nil
+}
+
+// Reads the "key= value" pairs of a MEME matrix header line.
+func memeHeaderValues(line string) map[string]string {
+	values := make(map[string]string)
+	fields := strings.Fields(strings.ReplaceAll(line, "=", "= "))
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.HasSuffix(fields[i], "=") {
+			values[strings.TrimSuffix(fields[i], "=")] = fields[i+1]
+		}
+	}
+	return values
+}
+
+func parseMEME(text string) ([]ParsedMotif, error) {
+	motifs := make([]ParsedMotif, 0)
+	lines := matrixLines(text)
+	for n := 0; n < len(lines); n++ {
+		line := lines[n]
+		switch {
+		case strings.HasPrefix(line, "ALPHABET="):
+			alphabet := strings.TrimSpace(strings.TrimPrefix(line, "ALPHABET="))
+			if alphabet != matrixBases {
+				return nil, fmt.Errorf("only the %s alphabet is supported, not %s", matrixBases, alphabet)
+			}
+		case strings.HasPrefix(line, "MOTIF"):
+			motifs = append(motifs, ParsedMotif{Names: strings.Fields(line)[1:], Matrices: make([]MotifMatrix, 0)})
+		case strings.HasPrefix(line, "letter-probability matrix") || strings.HasPrefix(line, "log-odds matrix"):
+			if len(motifs) == 0 {
+				return nil, fmt.Errorf("line %d starts a matrix outside of a MOTIF", n+1)
+			}
+			m := MotifMatrix{Kind: matrixFrequencies, Rows: make([][4]float64, 0)}
+			if strings.HasPrefix(line, "log-odds") {
+				m.Kind = matrixWeights
+			}
+			header := memeHeaderValues(line)
+			if alength, ok := header["alength"]; ok && alength != "4" {
+				return nil, fmt.Errorf("line %d has an alphabet of %s letters instead of 4", n+1, alength)
+			}
+
+			// The matrix runs until the first line which is not 4 numbers.
+			for n+1 < len(lines) {
+				values, ok := parseMatrixValues(strings.Fields(lines[n+1]))
+				if !ok || len(values) != 4 {
+					break
+				}
+				m.Rows = append(m.Rows, [4]float64{values[0], values[1], values[2], values[3]})
+				n++
+			}
+			if w, ok := header["w"]; ok && w != strconv.Itoa(len(m.Rows)) {
+				return nil, fmt.Errorf("a matrix of motif %s has %d rows, but declares w= %s", strings.Join(motifs[len(motifs)-1].Names, " "), len(m.Rows), w)
+			}
+			motifs[len(motifs)-1].Matrices = append(motifs[len(motifs)-1].Matrices, m)
+		}
+	}
+	return motifs, nil
+}
+
+func formatMatrixValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writes a matrix of a model in one of the matrix formats.
+func writeMotifMatrix(w io.Writer, format string, mm MotifModel, m MotifMatrix) error {
+	out := bufio.NewWriter(w)
+	switch format {
+	case formatHOCOMOCO:
+		fmt.Fprintf(out, ">%s\n", mm.Name)
+		for _, row := range m.Rows {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", formatMatrixValue(row[0]), formatMatrixValue(row[1]), formatMatrixValue(row[2]), formatMatrixValue(row[3]))
+		}
+	case formatJASPAR:
+		fmt.Fprintf(out, ">%s\t%s\n", mm.Name, mm.TranscriptionFactor)
+		for b, base := range matrixBases {
+			values := make([]string, len(m.Rows))
+			for i, row := range m.Rows {
+				values[i] = formatMatrixValue(row[b])
+			}
+			fmt.Fprintf(out, "%c  [ %s ]\n", base, strings.Join(values, " "))
+		}
+	case formatMEME:
+		fmt.Fprintf(out, "MEME version 4\n\nALPHABET= %s\n\nstrands: + -\n\n", matrixBases)
+		fmt.Fprintf(out, "Background letter frequencies\nA 0.25 C 0.25 G 0.25 T 0.25\n\n")
+		fmt.Fprintf(out, "MOTIF %s %s\n", mm.Name, mm.TranscriptionFactor)
+		switch m.Kind {
+		case matrixCounts:
+			fmt.Fprintf(out, "letter-probability matrix: alength= 4 w= %d nsites= %d E= 0\n", m.Width(), m.sites())
+			m = m.frequencies()
+		case matrixFrequencies:
+			fmt.Fprintf(out, "letter-probability matrix: alength= 4 w= %d\n", m.Width())
+		case matrixWeights:
+			fmt.Fprintf(out, "log-odds matrix: alength= 4 w= %d\n", m.Width())
+		}
+		for _, row := range m.Rows {
+			fmt.Fprintf(out, " %.6f  %.6f  %.6f  %.6f\n", row[0], row[1], row[2], row[3])
+		}
+	default:
+		return fmt.Errorf("unknown matrix format %s", format)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// The counts of a motif of width 3, and the same rows as frequencies.
+var (
+	testCounts      = [][4]float64{{8, 0, 1, 1}, {0, 10, 0, 0}, {2, 2, 6, 0}}
+	testFrequencies = [][4]float64{{0.8, 0, 0.1, 0.1}, {0, 1, 0, 0}, {0.2, 0.2, 0.6, 0}}
+)
+
+type parsedMatrix struct {
+	kind string
+	rows [][4]float64
+}
+
+type parsedMotif struct {
+	names    []string
+	matrices []parsedMatrix
+}
+
+func TestParseMotifMatrices(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		kind    string
+		text    string
+		want    []parsedMotif
+		wantErr bool
+	}{
+		{"hocomoco counts", formatHOCOMOCO, "", ">PBX1_MOUSE.H11MO.2.C extra words\n8\t0\t1\t1\n0 10 0 0\n2\t2\t6\t0\n",
+			[]parsedMotif{{[]string{"PBX1_MOUSE.H11MO.2.C"}, []parsedMatrix{{matrixCounts, testCounts}}}}, false},
+		{"hocomoco guessed frequencies", formatHOCOMOCO, "", ">A\n0.8 0 0.1 0.1\n0 1 0 0\n0.2 0.2 0.6 0\n",
+			[]parsedMotif{{[]string{"A"}, []parsedMatrix{{matrixFrequencies, testFrequencies}}}}, false},
+		{"hocomoco guessed weights", formatHOCOMOCO, "", ">A\n1.5 -2 0 -1\n",
+			[]parsedMotif{{[]string{"A"}, []parsedMatrix{{matrixWeights, [][4]float64{{1.5, -2, 0, -1}}}}}}, false},
+		{"hocomoco kind given", formatHOCOMOCO, matrixCounts, ">A\n0.8 0 0.1 0.1\n",
+			[]parsedMotif{{[]string{"A"}, []parsedMatrix{{matrixCounts, [][4]float64{{0.8, 0, 0.1, 0.1}}}}}}, false},
+		{"hocomoco without a name", formatHOCOMOCO, "", "# comment\n8 0 1 1\n",
+			[]parsedMotif{{[]string{}, []parsedMatrix{{matrixCounts, [][4]float64{{8, 0, 1, 1}}}}}}, false},
+		{"hocomoco two motifs", formatHOCOMOCO, "", ">A\n8 0 1 1\n>B\n0 10 0 0\n",
+			[]parsedMotif{
+				{[]string{"A"}, []parsedMatrix{{matrixCounts, [][4]float64{{8, 0, 1, 1}}}}},
+				{[]string{"B"}, []parsedMatrix{{matrixCounts, [][4]float64{{0, 10, 0, 0}}}}},
+			}, false},
+		{"hocomoco short row", formatHOCOMOCO, "", ">A\n8 0 1\n", nil, true},
+
+		{"jaspar bracketed", formatJASPAR, "", ">MA0001.1 PBX1\nA  [ 8 0 2 ]\nC  [ 0 10 2 ]\nG  [ 1 0 6 ]\nT  [ 1 0 0 ]\n",
+			[]parsedMotif{{[]string{"MA0001.1", "PBX1"}, []parsedMatrix{{matrixCounts, testCounts}}}}, false},
+		{"jaspar labelled out of order", formatJASPAR, "", ">M\nT [1 0 0]\nG [1 0 6]\nC [0 10 2]\nA [8 0 2]\n",
+			[]parsedMotif{{[]string{"M"}, []parsedMatrix{{matrixCounts, testCounts}}}}, false},
+		{"jaspar plain rows", formatJASPAR, "", ">M\n8 0 2\n0 10 2\n1 0 6\n1 0 0\n",
+			[]parsedMotif{{[]string{"M"}, []parsedMatrix{{matrixCounts, testCounts}}}}, false},
+		{"jaspar three bases", formatJASPAR, "", ">M\n8 0 2\n0 10 2\n1 0 6\n", nil, true},
+		{"jaspar uneven bases", formatJASPAR, "", ">M\n8 0 2\n0 10 2\n1 0 6\n1 0\n", nil, true},
+		{"jaspar repeated base", formatJASPAR, "", ">M\nA [8 0 2]\nA [0 10 2]\nG [1 0 6]\nT [1 0 0]\n", nil, true},
+		{"jaspar without a matrix", formatJASPAR, "", ">M\n>N\n8 0 2\n0 10 2\n1 0 6\n1 0 0\n", nil, true},
+
+		{"meme frequencies", formatMEME, "", "MEME version 4\n\nALPHABET= ACGT\n\nMOTIF PBX1 MOUSE:Pbx1\nletter-probability matrix: alength= 4 w= 3 nsites= 10 E= 0\n" +
+			" 0.8 0 0.1 0.1\n 0 1 0 0\n 0.2 0.2 0.6 0\nURL http://example.org\n",
+			[]parsedMotif{{[]string{"PBX1", "MOUSE:Pbx1"}, []parsedMatrix{{matrixFrequencies, testFrequencies}}}}, false},
+		{"meme both matrices", formatMEME, "", "MOTIF M\nlog-odds matrix: alength= 4 w= 1\n1 -1 -1 -1\nletter-probability matrix: alength= 4 w= 1\n0.7 0.1 0.1 0.1\n",
+			[]parsedMotif{{[]string{"M"}, []parsedMatrix{
+				{matrixWeights, [][4]float64{{1, -1, -1, -1}}},
+				{matrixFrequencies, [][4]float64{{0.7, 0.1, 0.1, 0.1}}},
+			}}}, false},
+		{"meme two motifs", formatMEME, "", "MOTIF A\nletter-probability matrix:\n1 0 0 0\nMOTIF B\nletter-probability matrix:\n0 1 0 0\n",
+			[]parsedMotif{
+				{[]string{"A"}, []parsedMatrix{{matrixFrequencies, [][4]float64{{1, 0, 0, 0}}}}},
+				{[]string{"B"}, []parsedMatrix{{matrixFrequencies, [][4]float64{{0, 1, 0, 0}}}}},
+			}, false},
+		{"meme wrong width", formatMEME, "", "MOTIF M\nletter-probability matrix: alength= 4 w= 2\n1 0 0 0\n", nil, true},
+		{"meme wrong alength", formatMEME, "", "MOTIF M\nletter-probability matrix: alength= 20 w= 1\n1 0 0 0\n", nil, true},
+		{"meme protein alphabet", formatMEME, "", "ALPHABET= ACDEFGHIKLMNPQRSTVWY\n", nil, true},
+		{"meme matrix before a motif", formatMEME, "", "letter-probability matrix:\n1 0 0 0\n", nil, true},
+
+		{"unknown format", "transfac", "", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			motifs, err := ParseMotifMatrices(tt.format, tt.kind, tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := make([]parsedMotif, len(motifs))
+			for i, motif := range motifs {
+				got[i] = parsedMotif{names: motif.Names, matrices: make([]parsedMatrix, len(motif.Matrices))}
+				for j, m := range motif.Matrices {
+					got[i].matrices[j] = parsedMatrix{m.Kind, m.Rows}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMotifMatrices = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Each format reads back the matrix it writes, MEME as frequencies of counts.
+func TestWriteMotifMatrixRoundTrip(t *testing.T) {
+	mm := MotifModel{Name: "PBX1_MOUSE.H11MO.2.C", Length: 3, TranscriptionFactor: "PBX1"}
+	tests := []struct {
+		format string
+		kind   string
+		want   parsedMatrix
+	}{
+		{formatHOCOMOCO, matrixCounts, parsedMatrix{matrixCounts, testCounts}},
+		{formatJASPAR, matrixCounts, parsedMatrix{matrixCounts, testCounts}},
+		{formatMEME, matrixCounts, parsedMatrix{matrixFrequencies, testFrequencies}},
+		{formatMEME, matrixFrequencies, parsedMatrix{matrixFrequencies, testFrequencies}},
+	}
+	for _, tt := range tests {
+		m := MotifMatrix{Model: mm.Name, Kind: tt.kind, Rows: testCounts}
+		if tt.kind == matrixFrequencies {
+			m.Rows = testFrequencies
+		}
+		var buf bytes.Buffer
+		err := writeMotifMatrix(&buf, tt.format, mm, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := ""
+		if tt.format != formatMEME {
+			kind = tt.kind
+		}
+		motifs, err := ParseMotifMatrices(tt.format, kind, buf.String())
+		if err != nil {
+			t.Fatalf("%s: reading back %q: %v", tt.format, buf.String(), err)
+		}
+		if len(motifs) != 1 || !motifs[0].named(mm.Name) || len(motifs[0].Matrices) != 1 {
+			t.Fatalf("%s: read back %+v", tt.format, motifs)
+		}
+		got := motifs[0].Matrices[0]
+		if got.Kind != tt.want.kind || !reflect.DeepEqual(got.Rows, tt.want.rows) {
+			t.Errorf("%s of %s: read back %s %v, want %s %v", tt.format, tt.kind, got.Kind, got.Rows, tt.want.kind, tt.want.rows)
+		}
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
 type MotifModel struct {
@@ -20,22 +21,122 @@ type MotifModel struct {
 	EntrezGene          int    `json:"EntrezGene" db:"EntrezGene"`
 }
 
+var motifModelList = ListSpec{
+	Fields: map[string]ListField{
+		"name":                {"Name", fieldString},
+		"length":              {"Length", fieldInt},
+		"quality":             {"Quality", fieldChar},
+		"uniprotid":           {"UniprotID", fieldString},
+		"transcriptionfactor": {"TranscriptionFactor", fieldString},
+		"tffamily":            {"TFFamily", fieldString},
+		"entrezgene":          {"EntrezGene", fieldInt},
+	},
+	Order: "Name",
+}
+
+/*
+Updates the model. Its instances end at their Start plus its Length, so a new
+Length moves them to new bins in the same transaction. The Length cannot change
+away from the width of the stored matrices of the model.
+*/
 func (mm MotifModel) Save(oldName string) (err error) {
-	query := "UPDATE MotifModels SET Name=? Length=? Quality=? UniprotID=? TranscriptionFactor=? TFFamily=? EntrezGene=? WHERE Name=?"
-	_, err = db.Exec(query, mm.Name, mm.Length, mm.Quality, mm.UniprotID, mm.TranscriptionFactor, mm.TFFamily, mm.EntrezGene, oldName)
-	return
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldLength int
+	err = tx.Get(&oldLength, "SELECT Length FROM MotifModels WHERE Name=?", oldName)
+	if err == sql.ErrNoRows {
+		return notFound("Motif Model")
+	}
+	if err != nil {
+		return err
+	}
+
+	if mm.Length != oldLength {
+		var widths []int
+		err = tx.Select(&widths, "SELECT COUNT(*) FROM MotifMatrices WHERE Model=? GROUP BY Kind", oldName)
+		if err != nil {
+			return err
+		}
+		for _, width := range widths {
+			if width != mm.Length {
+				return invalid("Length of Motif Model %s must stay %d, the width of its matrices.", oldName, width)
+			}
+		}
+	}
+
+	query := "UPDATE MotifModels SET Name=?, Length=?, Quality=?, UniprotID=?, TranscriptionFactor=?, TFFamily=?, EntrezGene=? WHERE Name=?"
+	_, err = tx.Exec(query, mm.Name, mm.Length, mm.Quality, mm.UniprotID, mm.TranscriptionFactor, mm.TFFamily, mm.EntrezGene, oldName)
+	if err != nil {
+		return dbError(err)
+	}
+
+	if mm.Length != oldLength {
+		err = rebinMotifInstances(tx, mm.Name, mm.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Recomputes the bins of the instances of a model for a new length.
+func rebinMotifInstances(tx *sqlx.Tx, model string, length int) error {
+	rows, err := tx.Query("SELECT rowid, Start FROM MotifInstances WHERE Model=?", model)
+	if err != nil {
+		return err
+	}
+	bins := make(map[int64]int)
+	for rows.Next() {
+		var rowid int64
+		var start int
+		err = rows.Scan(&rowid, &start)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		bins[rowid] = binFromRange(start, start+length)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for rowid, bin := range bins {
+		_, err = tx.Exec("UPDATE MotifInstances SET Bin=? WHERE rowid=?", bin, rowid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Deletes the model along with its matrices, which belong to it.
 func (mm MotifModel) Delete() (err error) {
-	query := "DELETE FROM MotifModels WHERE Name=?"
-	_, err = db.Exec(query, mm.Name)
-	return
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM MotifMatrices WHERE Model=?", mm.Name)
+	if err != nil {
+		return dbError(err)
+	}
+	_, err = tx.Exec("DELETE FROM MotifModels WHERE Name=?", mm.Name)
+	if err != nil {
+		return dbError(err)
+	}
+	return tx.Commit()
 }
 
 func (mm MotifModel) CreateMotifModel() (err error) {
 	query := "INSERT INTO MotifModels VALUES (?, ?, ?, ?, ?, ?, ?)"
 	_, err = db.Exec(query, mm.Name, mm.Length, mm.Quality, mm.UniprotID, mm.TranscriptionFactor, mm.TFFamily, mm.EntrezGene)
-	return
+	return dbError(err)
 }
 
 func CreateMotifModel(mms []MotifModel) (err error) {
@@ -93,31 +194,18 @@ func GetMotifModel(Name string) (MotifModel, error) {
 		return m, nil
 	}
 
-	return MotifModel{}, errors.New("not_found")
+	return MotifModel{}, notFound("Motif Model")
 }
 
 func handleGetMotifModels(w http.ResponseWriter, r *http.Request) {
-	mms, err := GetMotifModels()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Motif Models.")
-		return
-	}
-
-	json.NewEncoder(w).Encode(mms)
+	serveList[MotifModel](w, r, motifModelList, "Motif Models", "SELECT * FROM MotifModels")
 }
 
 func handleGetMotifModel(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	mm, err := GetMotifModel(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Motif Model.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Motif Models.")
-		}
+		writeError(w, err, "Could not fetch Motif Models.")
 		return
 	}
 
@@ -128,45 +216,37 @@ func handleEditMotifModel(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	mm, err := GetMotifModel(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Motif Model.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Motif Models.")
-		}
+		writeError(w, err, "Could not fetch Motif Models.")
 		return
 	}
 
 	var newMM MotifModel
 	err = json.NewDecoder(r.Body).Decode(&newMM)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body should be a Motif Model.")
+		writeBadRequest(w, "Request body should be a Motif Model.")
+		return
+	}
+
+	err = newMM.Save(mm.Name)
+	if err != nil {
+		writeError(w, err, "Could not update Motif Model.")
 		return
 	}
 
-	newMM.Save(mm.Name)
+	w.WriteHeader(http.StatusOK)
 }
 
 func handleDeleteMotifModel(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	mm, err := GetMotifModel(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Motif Model.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Motif Models.")
-		}
+		writeError(w, err, "Could not fetch Motif Models.")
 		return
 	}
 
 	err = mm.Delete()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not delete Motif Model.\n", err.Error())
+		writeError(w, err, "Could not delete Motif Model.")
 		return
 	}
 
@@ -177,15 +257,13 @@ func handleCreateMotifModels(w http.ResponseWriter, r *http.Request) {
 	var models []MotifModel
 	err := json.NewDecoder(r.Body).Decode(&models)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Request body must be an array of Motif Models.")
+		writeBadRequest(w, "Request body must be an array of Motif Models.")
 		return
 	}
 
 	err = CreateMotifModel(models)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not create Motif Models.\n", err.Error())
+		writeError(w, err, "Could not create Motif Models.")
 		return
 	}
 
@@ -196,31 +274,24 @@ func handleGetInstancesOfMotif(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	mm, err := GetMotifModel(v["name"])
 	if err != nil {
-		if err.Error() == "not_found" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Could not find Motif Model.")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not fetch Motif Models.")
-		}
-		return
-	}
-
-	instances, err := mm.GetInstances()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Could not fetch Motif Instances.")
+		writeError(w, err, "Could not fetch Motif Models.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(instances)
+	serveList[MotifInstance](w, r, motifInstanceList, "Motif Instances", motifInstanceWithLengthQuery+" WHERE MI.Model=?", mm.Name)
 }
 
 func init() {
-	registerRoute(Route{"/motifmodels", handleGetMotifModels, "GET"})
-	registerRoute(Route{"/motifmodels/{name}", handleGetMotifModel, "GET"})
-	registerRoute(Route{"/motifmodels/{name}", handleEditMotifModel, "PUT"})
-	registerRoute(Route{"/motifmodels/{name}", handleDeleteMotifModel, "DELETE"})
-	registerRoute(Route{"/motifmodels", handleCreateMotifModels, "POST"})
-	registerRoute(Route{"/motifmodels/{name}/instances", handleGetInstancesOfMotif, "GET"})
+	registerRoute(Route{path: "/motifmodels", handler: handleGetMotifModels, method: "GET",
+		summary: "List motif models", response: []MotifModel{}, list: &motifModelList})
+	registerRoute(Route{path: "/motifmodels/{name}", handler: handleGetMotifModel, method: "GET",
+		summary: "Get a motif model", response: MotifModel{}})
+	registerRoute(Route{path: "/motifmodels/{name}", handler: handleEditMotifModel, method: "PUT",
+		summary: "Edit a motif model", body: MotifModel{}})
+	registerRoute(Route{path: "/motifmodels/{name}", handler: handleDeleteMotifModel, method: "DELETE",
+		summary: "Delete a motif model"})
+	registerRoute(Route{path: "/motifmodels", handler: handleCreateMotifModels, method: "POST",
+		summary: "Create motif models", body: []MotifModel{}})
+	registerRoute(Route{path: "/motifmodels/{name}/instances", handler: handleGetInstancesOfMotif, method: "GET",
+		summary: "List the instances of a motif model", response: []MotifInstance{}, list: &motifInstanceList})
 }
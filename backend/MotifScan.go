@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Motif scanning
+Loci are scanned on both strands for the sites of Motif Models, using their
+weight matrices (see MotifMatrix.go) and the sequence of the genome (see
+Genome.go). A window of a locus is a hit when its score, the sum of the weights
+of its bases, reaches the threshold of its model: either MinScore, or the score
+a random sequence of uniform bases reaches with probability PValue. Windows
+with bases other than A, C, G and T are skipped.
+Hits are written as Motif Instances of the cell type. Instances are unique by
+their start, so only the best hit of each start in a locus is kept, and starts
+already holding an instance of the cell type are left as they are.
+Loci are scanned in parallel. Scans run as the RUN_MOTIF_SCAN command, or as
+background jobs of the API, one at a time.
+**/
+
+const defaultScanPValue = 1e-4
+
+// Scores are rounded to 1/pValueScale to find the threshold of a p-value.
+const pValueScale = 100
+
+// Hits are written in transactions of this many.
+const scanBatchSize = 5000
+
+type ScanRequest struct {
+	CellType string `json:"CellType"`
+	// Names of the models to scan with, every model with a matrix when empty.
+	Models []string `json:"Models"`
+	// At most one may be given. Without either, PValue is 0.0001.
+	PValue   *float64 `json:"PValue"`
+	MinScore *float64 `json:"MinScore"`
+	// Only loci overlapping the region are scanned, every locus when null.
+	Region *string `json:"Region"`
+}
+
+type ScanCounts struct {
+	// Number of loci to scan, and scanned so far.
+	Loci    int `json:"Loci"`
+	Scanned int `json:"Scanned"`
+	// Loci on chromosomes, or past their end, missing from the genome FASTA.
+	Unsequenced int `json:"Unsequenced"`
+	Hits        int `json:"Hits"`
+	// Hits written as new Motif Instances, the others starting where one already was.
+	Inserted int `json:"Inserted"`
+}
+
+type scanModel struct {
+	name      string
+	length    int
+	weights   [][4]float64
+	threshold float64
+}
+
+// A scan ready to run, its request checked.
+type motifScan struct {
+	cellType string
+	genome   *Genome
+	models   []scanModel
+	loci     []Locus
+}
+
+/*
+Returns the lowest score reached with probability at most p by a sequence of
+uniform random bases. Its distribution is computed over scores rounded to
+1/pValueScale, position by position.
+*/
+func scoreForPValue(weights [][4]float64, p float64) float64 {
+	// Probabilities of each rounded score, offset by the lowest score so far.
+	dist := []float64{1}
+	lowest := 0
+	for _, row := range weights {
+		var rounded [4]int
+		for b, w := range row {
+			rounded[b] = int(math.Round(w * pValueScale))
+		}
+		rowLow, rowHigh := rounded[0], rounded[0]
+		for _, r := range rounded[1:] {
+			if r < rowLow {
+				rowLow = r
+			}
+			if r > rowHigh {
+				rowHigh = r
+			}
+		}
+
+		next := make([]float64, len(dist)+rowHigh-rowLow)
+		for s, prob := range dist {
+			if prob == 0 {
+				continue
+			}
+			for _, r := range rounded {
+				next[s+r-rowLow] += prob / 4
+			}
+		}
+		dist = next
+		lowest += rowLow
+	}
+
+	tail := 0.0
+	for s := len(dist) - 1; s >= 0; s-- {
+		if tail+dist[s] > p {
+			return float64(lowest+s+1) / pValueScale
+		}
+		tail += dist[s]
+	}
+	return float64(lowest) / pValueScale
+}
+
+// Checks a request and reads everything its scan needs, other than sequences.
+func prepareScan(req ScanRequest) (*motifScan, error) {
+	cell, err := GetCellType(req.CellType)
+	if err != nil {
+		return nil, err
+	}
+	if req.PValue != nil && req.MinScore != nil {
+		return nil, invalid("Give either PValue or MinScore, not both.")
+	}
+	if req.PValue != nil && (*req.PValue <= 0 || *req.PValue > 1) {
+		return nil, invalid("PValue must be above 0 and at most 1.")
+	}
+	genome, err := GetGenome()
+	if err != nil {
+		return nil, err
+	}
+
+	names := req.Models
+	if len(names) == 0 {
+		err = db.Select(&names, "SELECT DISTINCT Model FROM MotifMatrices ORDER BY Model")
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, invalid("No Motif Model has a matrix to scan with.")
+		}
+	}
+
+	s := &motifScan{cellType: cell.Type, genome: genome, models: make([]scanModel, 0, len(names))}
+	for _, name := range names {
+		mm, err := GetMotifModel(name)
+		if err != nil {
+			return nil, err
+		}
+		pwm, err := GetMotifMatrix(mm.Name, matrixWeights)
+		if errors.Is(err, ErrNotFound) {
+			return nil, invalid("Motif Model %s has no matrix to scan with.", mm.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m := scanModel{name: mm.Name, length: mm.Length, weights: pwm.Rows}
+		switch {
+		case req.MinScore != nil:
+			m.threshold = *req.MinScore
+		case req.PValue != nil:
+			m.threshold = scoreForPValue(m.weights, *req.PValue)
+		default:
+			m.threshold = scoreForPValue(m.weights, defaultScanPValue)
+		}
+		s.models = append(s.models, m)
+	}
+
+	if req.Region != nil {
+		region, err := ParseRegion(*req.Region)
+		if err != nil {
+			return nil, err
+		}
+		s.loci, err = GetLociInRegion(region.Chr, region.Start, region.End)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.loci, err = GetLoci()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Bases as indexes of the rows of a matrix, with anything else as 4.
+var baseCodes = func() (codes [256]byte) {
+	for i := range codes {
+		codes[i] = 4
+	}
+	for i, b := range matrixBases {
+		codes[b] = byte(i)
+	}
+	return
+}()
+
+// Returns the best hit of each start of a locus, given its sequence.
+func (s *motifScan) scanLocus(l Locus, seq []byte) []MotifInstance {
+	codes := make([]byte, len(seq))
+	for i, b := range seq {
+		codes[i] = baseCodes[b]
+	}
+
+	best := make(map[int]MotifInstance)
+	for _, m := range s.models {
+		w := len(m.weights)
+		for i := 0; i+w <= len(codes); i++ {
+			// The reverse strand reads the complement of the window backwards,
+			// and complementary bases have codes adding up to 3.
+			forward, reverse := 0.0, 0.0
+			valid := true
+			for j := 0; j < w; j++ {
+				c := codes[i+j]
+				if c > 3 {
+					valid = false
+					i += j
+					break
+				}
+				forward += m.weights[j][c]
+				reverse += m.weights[w-1-j][3-c]
+			}
+			if !valid || (forward < m.threshold && reverse < m.threshold) {
+				continue
+			}
+
+			hit := MotifInstance{CellType: s.cellType, Chr: l.Chr, Start: l.Start + i, Forward: forward >= reverse,
+				ThresholdScore: math.Max(forward, reverse), LocusID: l.ID, Model: m.name, Length: m.length}
+			if kept, ok := best[hit.Start]; !ok || hit.ThresholdScore > kept.ThresholdScore {
+				best[hit.Start] = hit
+			}
+		}
+	}
+
+	hits := make([]MotifInstance, 0, len(best))
+	for _, hit := range best {
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Start < hits[j].Start })
+	return hits
+}
+
+// Writes hits as Motif Instances, leaving out those starting where one already is.
+func insertScanHits(hits []MotifInstance) (inserted int, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`INSERT OR IGNORE INTO MotifInstances (CellType, Chr, Start, Forward, ThresholdScore, LocusID, Model, Bin) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, h := range hits {
+		result, err := stmt.Exec(h.CellType, h.Chr, h.Start, h.Forward, h.ThresholdScore, h.LocusID, h.Model, binFromRange(h.Start, h.Start+h.Length))
+		if err != nil {
+			return 0, dbError(err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		inserted += int(n)
+	}
+	return inserted, tx.Commit()
+}
+
+/*
+Scans every locus, reading and scanning them in parallel while writing the
+hits from this goroutine. progress is called with the counts after each
+locus. Stops with the error of ctx once it is done.
+*/
+func (s *motifScan) Run(ctx context.Context, progress func(ScanCounts)) (ScanCounts, error) {
+	counts := ScanCounts{Loci: len(s.loci)}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		hits        []MotifInstance
+		unsequenced bool
+		err         error
+	}
+	loci := make(chan Locus)
+	results := make(chan result)
+
+	go func() {
+		defer close(loci)
+		for _, l := range s.loci {
+			select {
+			case loci <- l:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for l := range loci {
+				var r result
+				seq, err := s.genome.Sequence(l.Chr, l.Start, l.End)
+				switch {
+				case errors.Is(err, ErrValidation):
+					r.unsequenced = true
+				case err != nil:
+					r.err = err
+				default:
+					r.hits = s.scanLocus(l, seq)
+				}
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	pending := make([]MotifInstance, 0, scanBatchSize)
+	flush := func() error {
+		inserted, err := insertScanHits(pending)
+		counts.Inserted += inserted
+		pending = pending[:0]
+		return err
+	}
+	for r := range results {
+		if r.err != nil {
+			return counts, r.err
+		}
+		counts.Scanned++
+		if r.unsequenced {
+			counts.Unsequenced++
+		}
+		counts.Hits += len(r.hits)
+		pending = append(pending, r.hits...)
+		if len(pending) >= scanBatchSize {
+			err := flush()
+			if err != nil {
+				return counts, err
+			}
+		}
+		progress(counts)
+	}
+	// Hits found before a cancellation are still written.
+	err := flush()
+	if err != nil {
+		return counts, err
+	}
+	progress(counts)
+	return counts, ctx.Err()
+}
+
+/** Scan jobs **/
+
+const (
+	scanQueued    = "queued"
+	scanRunning   = "running"
+	scanDone      = "done"
+	scanFailed    = "failed"
+	scanCancelled = "cancelled"
+)
+
+type ScanJob struct {
+	ID      int         `json:"ID"`
+	Request ScanRequest `json:"Request"`
+	State   string      `json:"State"`
+	ScanCounts
+	// Set when the job failed.
+	Error *string `json:"Error"`
+	// RFC 3339 times, null until the job gets there.
+	Submitted string  `json:"Submitted"`
+	Started   *string `json:"Started"`
+	Finished  *string `json:"Finished"`
+
+	cancel context.CancelFunc
+}
+
+// Jobs are only kept in memory, so they are forgotten on restart.
+var scanJobs = struct {
+	sync.Mutex
+	jobs map[int]*ScanJob
+	next int
+}{jobs: make(map[int]*ScanJob), next: 1}
+
+// Held by the running scan, as SQLite writes one transaction at a time anyway.
+var scanRunner sync.Mutex
+
+func timestamp() *string {
+	t := time.Now().UTC().Format(time.RFC3339)
+	return &t
+}
+
+// Queues a prepared scan as a job, running it once the scans before it are done.
+func startScanJob(req ScanRequest, s *motifScan) ScanJob {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	scanJobs.Lock()
+	job := &ScanJob{ID: scanJobs.next, Request: req, State: scanQueued, ScanCounts: ScanCounts{Loci: len(s.loci)},
+		Submitted: *timestamp(), cancel: cancel}
+	scanJobs.jobs[job.ID] = job
+	scanJobs.next++
+	snapshot := *job
+	scanJobs.Unlock()
+
+	go func() {
+		scanRunner.Lock()
+		defer scanRunner.Unlock()
+		defer cancel()
+
+		scanJobs.Lock()
+		if ctx.Err() != nil {
+			scanJobs.Unlock()
+			return
+		}
+		job.State, job.Started = scanRunning, timestamp()
+		scanJobs.Unlock()
+
+		counts, err := s.Run(ctx, func(c ScanCounts) {
+			scanJobs.Lock()
+			job.ScanCounts = c
+			scanJobs.Unlock()
+		})
+
+		scanJobs.Lock()
+		defer scanJobs.Unlock()
+		job.ScanCounts, job.Finished = counts, timestamp()
+		switch {
+		case errors.Is(err, context.Canceled):
+			job.State = scanCancelled
+		case err != nil:
+			fmt.Printf("[Warn] Motif scan %d failed: %s\n", job.ID, err)
+			detail := err.Error()
+			job.State, job.Error = scanFailed, &detail
+		default:
+			job.State = scanDone
+		}
+	}()
+
+	return snapshot
+}
+
+func GetScanJobs() []ScanJob {
+	scanJobs.Lock()
+	defer scanJobs.Unlock()
+
+	jobs := make([]ScanJob, 0, len(scanJobs.jobs))
+	for _, job := range scanJobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+func GetScanJob(id int) (ScanJob, error) {
+	scanJobs.Lock()
+	defer scanJobs.Unlock()
+
+	job, ok := scanJobs.jobs[id]
+	if !ok {
+		return ScanJob{}, notFound("Motif Scan")
+	}
+	return *job, nil
+}
+
+/*
+Cancels a queued or running job, keeping the hits it already wrote, or forgets
+a finished one.
+*/
+func CancelScanJob(id int) (ScanJob, error) {
+	scanJobs.Lock()
+	defer scanJobs.Unlock()
+
+	job, ok := scanJobs.jobs[id]
+	if !ok {
+		return ScanJob{}, notFound("Motif Scan")
+	}
+	switch job.State {
+	case scanQueued:
+		job.cancel()
+		job.State, job.Finished = scanCancelled, timestamp()
+	case scanRunning:
+		// The job records its own end once its workers have stopped.
+		job.cancel()
+	default:
+		delete(scanJobs.jobs, id)
+	}
+	return *job, nil
+}
+
+// Runs the scan described by the SCAN_ environment variables, see the README.
+func RunMotifScan() {
+	req := ScanRequest{CellType: os.Getenv("SCAN_CELL_TYPE")}
+	if models := os.Getenv("SCAN_MODELS"); models != "" {
+		req.Models = strings.Split(models, ",")
+	}
+	for _, setting := range []struct {
+		env   string
+		value **float64
+	}{{"SCAN_PVALUE", &req.PValue}, {"SCAN_MIN_SCORE", &req.MinScore}} {
+		raw, set := os.LookupEnv(setting.env)
+		if !set {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			log.Fatalf("%s must be a number.", setting.env)
+		}
+		*setting.value = &parsed
+	}
+	if region, set := os.LookupEnv("SCAN_REGION"); set {
+		req.Region = &region
+	}
+
+	s, err := prepareScan(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("[Info] Scanning %d loci with %d Motif Models.\n", len(s.loci), len(s.models))
+
+	counts, err := s.Run(context.Background(), func(ScanCounts) {})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("[Info] Scanned %d loci (%d without sequence), found %d hits and created %d Motif Instances.\n",
+		counts.Scanned, counts.Unsequenced, counts.Hits, counts.Inserted)
+}
+
+/** HTTP Routes **/
+
+// Reads the ID of a scan job from the path, writing a 400 if it is not a number.
+func scanJobID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id < 1 {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Motif Scan IDs are positive integers.")
+		return 0, false
+	}
+	return id, true
+}
+
+func handleCreateMotifScan(w http.ResponseWriter, r *http.Request) {
+	var req ScanRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeBadRequest(w, "Request body should be a Scan Request.")
+		return
+	}
+
+	s, err := prepareScan(req)
+	if err != nil {
+		writeError(w, err, "Could not start the Motif Scan.")
+		return
+	}
+
+	job := startScanJob(req, s)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/motifscans/%d", job.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleGetMotifScans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetScanJobs())
+}
+
+func handleGetMotifScan(w http.ResponseWriter, r *http.Request) {
+	id, ok := scanJobID(w, r)
+	if !ok {
+		return
+	}
+	job, err := GetScanJob(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Scans.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleDeleteMotifScan(w http.ResponseWriter, r *http.Request) {
+	id, ok := scanJobID(w, r)
+	if !ok {
+		return
+	}
+	job, err := CancelScanJob(id)
+	if err != nil {
+		writeError(w, err, "Could not cancel Motif Scan.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func init() {
+	registerCommand(Command{"RUN_MOTIF_SCAN", RunMotifScan})
+
+	registerRoute(Route{path: "/motifscans", handler: handleCreateMotifScan, method: "POST",
+		summary: "Start scanning loci for motif instances in the background", body: ScanRequest{}, response: ScanJob{}})
+	registerRoute(Route{path: "/motifscans", handler: handleGetMotifScans, method: "GET",
+		summary: "List the motif scans since the server started", response: []ScanJob{}})
+	registerRoute(Route{path: "/motifscans/{id}", handler: handleGetMotifScan, method: "GET",
+		summary: "Get the state and progress of a motif scan", response: ScanJob{}})
+	registerRoute(Route{path: "/motifscans/{id}", handler: handleDeleteMotifScan, method: "DELETE",
+		summary: "Cancel a queued or running motif scan, or forget a finished one", response: ScanJob{}})
+}
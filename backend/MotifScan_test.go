@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Weights scoring 1 for each base of ACG and -1 for any other, so ACG scores 3
+// on the forward strand and its reverse complement CGT 3 on the reverse one.
+var acgWeights = [][4]float64{{1, -1, -1, -1}, {-1, 1, -1, -1}, {-1, -1, 1, -1}}
+
+func TestScanLocus(t *testing.T) {
+	type hit struct {
+		start   int
+		forward bool
+		score   float64
+	}
+	tests := []struct {
+		name      string
+		seq       string
+		threshold float64
+		want      []hit
+	}{
+		{"forward", "TTACGAA", 3, []hit{{2, true, 3}}},
+		{"reverse", "TTCGTAA", 3, []hit{{2, false, 3}}},
+		{"both strands", "ACGTTCGTNACGA", 3, []hit{{0, true, 3}, {1, false, 3}, {5, false, 3}, {9, true, 3}}},
+		{"N in every window", "ACNCGNACNCG", 3, []hit{}},
+		{"hit right after N", "NNACG", 3, []hit{{2, true, 3}}},
+		{"hit right before N", "ACGN", 3, []hit{{0, true, 3}}},
+		{"lower threshold", "ACT", 1, []hit{{0, true, 1}}},
+		{"shorter than the motif", "AC", -10, []hit{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &motifScan{cellType: "Test", models: []scanModel{{name: "ACG", length: 3, weights: acgWeights, threshold: tt.threshold}}}
+			l := Locus{ID: "chrX:1000-2000", Chr: "chrX", Start: 1000, End: 2000}
+			hits := s.scanLocus(l, []byte(tt.seq))
+
+			got := make([]hit, len(hits))
+			for i, h := range hits {
+				if h.CellType != "Test" || h.Chr != "chrX" || h.LocusID != l.ID || h.Model != "ACG" || h.Length != 3 {
+					t.Errorf("hit %d = %+v, missing its locus or model", i, h)
+				}
+				got[i] = hit{h.Start - l.Start, h.Forward, h.ThresholdScore}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scanLocus(%s) = %v, want %v", tt.seq, got, tt.want)
+			}
+		})
+	}
+}
+
+// Of the models hitting a start, only the best scoring one is kept.
+func TestScanLocusKeepsBestModel(t *testing.T) {
+	weak := [][4]float64{{0.5, 0, 0, 0}, {0, 0.5, 0, 0}, {0, 0, 0.5, 0}}
+	s := &motifScan{cellType: "Test", models: []scanModel{
+		{name: "weak", length: 3, weights: weak, threshold: 1.5},
+		{name: "ACG", length: 3, weights: acgWeights, threshold: 3},
+	}}
+	hits := s.scanLocus(Locus{ID: "chrX:0-5", Chr: "chrX", Start: 0, End: 5}, []byte("ACGGG"))
+	if len(hits) != 1 || hits[0].Model != "ACG" || hits[0].Start != 0 {
+		t.Errorf("scanLocus = %+v, want ACG at 0 only", hits)
+	}
+}
+
+/*
+Thresholds are the lowest score, in steps of 1/pValueScale, reached with
+probability at most p, so when only the consensus is that rare it is the score
+of a single mismatch plus a step.
+*/
+func TestScoreForPValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights [][4]float64
+		p       float64
+		want    float64
+	}{
+		{"every sequence", acgWeights, 1, -3},
+		{"only the consensus", acgWeights, 1.0 / 64, 1.01},
+		{"at most one mismatch", acgWeights, 10.0 / 64, -0.99},
+		{"rarer than the consensus", acgWeights, 0.001, 3.01},
+		{"one position", [][4]float64{{1, 0, 0, -1}}, 0.25, 0.01},
+		{"two bases tied", [][4]float64{{1, 0, 0, -1}}, 0.8, -0.99},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scoreForPValue(tt.weights, tt.p)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("scoreForPValue(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+// The threshold agrees with enumerating every sequence, for weights already rounded to 1/pValueScale.
+func TestScoreForPValueEnumerated(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const width = 5
+	weights := make([][4]float64, width)
+	for i := range weights {
+		for b := range weights[i] {
+			weights[i][b] = float64(rng.Intn(401)-200) / pValueScale
+		}
+	}
+
+	scores := make([]float64, 0, 1<<(2*width))
+	for seq := 0; seq < 1<<(2*width); seq++ {
+		score := 0.0
+		for i := 0; i < width; i++ {
+			score += weights[i][(seq>>(2*i))&3]
+		}
+		scores = append(scores, score)
+	}
+	tail := func(threshold float64) float64 {
+		n := 0
+		for _, s := range scores {
+			if s >= threshold-1e-9 {
+				n++
+			}
+		}
+		return float64(n) / float64(len(scores))
+	}
+
+	for _, p := range []float64{0.5, 0.1, 0.01, 0.002} {
+		threshold := scoreForPValue(weights, p)
+		if tail(threshold) > p {
+			t.Errorf("p %v: threshold %v is reached with probability %v", p, threshold, tail(threshold))
+		}
+		if lower := threshold - 1.0/pValueScale; tail(lower) <= p {
+			t.Errorf("p %v: threshold %v is not the lowest, %v is reached with probability %v", p, threshold, lower, tail(lower))
+		}
+	}
+}
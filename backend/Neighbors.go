@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Neighbourhoods
+Loci are the nodes of a graph, connected whenever they are anchors of the same
+interaction. A neighbourhood is everything reachable from a starting set of loci
+within some number of hops, walked breadth first with one query per hop and
+batch of loci. Genes are reached through the loci they are in.
+**/
+
+// The furthest a neighbourhood may reach, as each hop can multiply its size.
+const maxNeighborDepth = 5
+
+// A locus reached from the start, and the interactions walked to reach it.
+type NeighborLocus struct {
+	Locus
+	Distance     int     `json:"Distance"`
+	Interactions []int64 `json:"Interactions"`
+}
+
+// A gene in a reached locus, at the distance of the nearest such locus.
+type NeighborGene struct {
+	Gene
+	Distance     int     `json:"Distance"`
+	Interactions []int64 `json:"Interactions"`
+}
+
+type Neighborhood struct {
+	Loci  []NeighborLocus `json:"Loci"`
+	Genes []NeighborGene  `json:"Genes"`
+}
+
+// An edge of the locus graph.
+type neighborEdge struct {
+	From        string `db:"FromLocus"`
+	To          string `db:"ToLocus"`
+	Interaction int64  `db:"Interaction"`
+}
+
+// Returns the edges leaving the given loci, in a stable order.
+func neighborEdges(loci []string, celltype string) (edges []neighborEdge, err error) {
+	edges = make([]neighborEdge, 0)
+	err = eachInChunk(loci, func(args []interface{}) error {
+		query := fmt.Sprintf(`SELECT P1.Locus AS FromLocus, P2.Locus AS ToLocus, I.ID AS Interaction
+			FROM InteractionParticipation AS P1
+			INNER JOIN InteractionParticipation AS P2 ON P2.Interaction=P1.Interaction AND P2.Locus<>P1.Locus
+			INNER JOIN Interactions AS I ON I.ID=P1.Interaction
+			WHERE P1.Locus IN (%s) AND (? = '' OR I.CellType=?)`, placeholders(len(args)))
+		rows, err := db.Queryx(query, append(args, celltype, celltype)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var e neighborEdge
+			err = rows.StructScan(&e)
+			if err != nil {
+				return err
+			}
+			edges = append(edges, e)
+		}
+		return rows.Err()
+	})
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		if edges[i].Interaction != edges[j].Interaction {
+			return edges[i].Interaction < edges[j].Interaction
+		}
+		return edges[i].To < edges[j].To
+	})
+	return
+}
+
+/*
+Walks the interaction graph from the starting loci up to depth hops, limited to
+the interactions of one cell type unless it is empty. The starting loci are
+included at distance 0.
+*/
+func GetNeighborhood(start []string, celltype string, depth int) (n Neighborhood, err error) {
+	paths := make(map[string][]int64, len(start))
+	distances := make(map[string]int, len(start))
+	frontier := make([]string, 0, len(start))
+	for _, id := range start {
+		if _, seen := paths[id]; !seen {
+			paths[id] = []int64{}
+			distances[id] = 0
+			frontier = append(frontier, id)
+		}
+	}
+
+	for hop := 1; hop <= depth && len(frontier) > 0; hop++ {
+		sort.Strings(frontier)
+		edges, err := neighborEdges(frontier, celltype)
+		if err != nil {
+			return n, err
+		}
+
+		next := make([]string, 0)
+		for _, e := range edges {
+			if _, seen := paths[e.To]; seen {
+				continue
+			}
+			path := make([]int64, len(paths[e.From]), len(paths[e.From])+1)
+			copy(path, paths[e.From])
+			paths[e.To] = append(path, e.Interaction)
+			distances[e.To] = hop
+			next = append(next, e.To)
+		}
+		frontier = next
+	}
+
+	reached := make([]string, 0, len(paths))
+	for id := range paths {
+		reached = append(reached, id)
+	}
+
+	n.Loci = make([]NeighborLocus, 0, len(reached))
+	n.Genes = make([]NeighborGene, 0)
+	genes := make(map[string]int)
+	err = eachInChunk(reached, func(args []interface{}) error {
+		rows, err := db.Queryx(fmt.Sprintf(`SELECT * FROM Loci WHERE ID IN (%s)`, placeholders(len(args))), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l Locus
+			err = rows.StructScan(&l)
+			if err != nil {
+				return err
+			}
+			n.Loci = append(n.Loci, NeighborLocus{l, distances[l.ID], paths[l.ID]})
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		geneRows, err := db.Queryx(fmt.Sprintf(`SELECT GIL.Locus, G.* FROM GeneInLocus AS GIL
+			INNER JOIN Genes AS G ON G.Name=GIL.Gene WHERE GIL.Locus IN (%s)`, placeholders(len(args))), args...)
+		if err != nil {
+			return err
+		}
+		defer geneRows.Close()
+		for geneRows.Next() {
+			var g struct {
+				Locus string `db:"Locus"`
+				Gene
+			}
+			err = geneRows.StructScan(&g)
+			if err != nil {
+				return err
+			}
+			i, seen := genes[g.Name]
+			if !seen {
+				genes[g.Name] = len(n.Genes)
+				n.Genes = append(n.Genes, NeighborGene{g.Gene, distances[g.Locus], paths[g.Locus]})
+			} else if distances[g.Locus] < n.Genes[i].Distance {
+				n.Genes[i].Distance = distances[g.Locus]
+				n.Genes[i].Interactions = paths[g.Locus]
+			}
+		}
+		return geneRows.Err()
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(n.Loci, func(i, j int) bool {
+		if n.Loci[i].Distance != n.Loci[j].Distance {
+			return n.Loci[i].Distance < n.Loci[j].Distance
+		}
+		return n.Loci[i].ID < n.Loci[j].ID
+	})
+	sort.Slice(n.Genes, func(i, j int) bool {
+		if n.Genes[i].Distance != n.Genes[j].Distance {
+			return n.Genes[i].Distance < n.Genes[j].Distance
+		}
+		return n.Genes[i].Name < n.Genes[j].Name
+	})
+	return
+}
+
+/** HTTP Routes **/
+
+// Reads the celltype and depth parameters of a neighbourhood, writing a response if they are invalid.
+func parseNeighborParams(w http.ResponseWriter, r *http.Request) (celltype string, depth int, ok bool) {
+	celltype = r.URL.Query().Get("celltype")
+	if celltype != "" {
+		_, err := GetCellType(celltype)
+		if err != nil {
+			writeError(w, err, "Unable to fetch Cell Type.")
+			return "", 0, false
+		}
+	}
+
+	depth = 1
+	if raw := r.URL.Query().Get("depth"); raw != "" {
+		var err error
+		depth, err = strconv.Atoi(raw)
+		if err != nil || depth < 1 || depth > maxNeighborDepth {
+			writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("depth must be an integer from 1 to %d.", maxNeighborDepth))
+			return "", 0, false
+		}
+	}
+
+	return celltype, depth, true
+}
+
+func serveNeighborhood(w http.ResponseWriter, r *http.Request, start []string) {
+	celltype, depth, ok := parseNeighborParams(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := GetNeighborhood(start, celltype, depth)
+	if err != nil {
+		writeError(w, err, "Could not fetch neighbours.")
+		return
+	}
+
+	json.NewEncoder(w).Encode(n)
+}
+
+func handleGetLocusNeighbors(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci.")
+		return
+	}
+
+	serveNeighborhood(w, r, []string{locus.ID})
+}
+
+// A gene starts from every locus it is in.
+func handleGetGeneNeighbors(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	gene, err := GetGene(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Genes.")
+		return
+	}
+
+	loci, err := gene.GetLoci()
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci of Gene.")
+		return
+	}
+
+	start := make([]string, len(loci))
+	for i, l := range loci {
+		start[i] = l.ID
+	}
+	serveNeighborhood(w, r, start)
+}
+
+func init() {
+	registerRoute(Route{path: "/loci/{id}/neighbors", handler: handleGetLocusNeighbors, method: "GET",
+		summary: "Get the loci and genes reachable from a locus through interactions", response: Neighborhood{}, query: []string{"celltype", "depth"}})
+	registerRoute(Route{path: "/genes/{name}/neighbors", handler: handleGetGeneNeighbors, method: "GET",
+		summary: "Get the loci and genes reachable from the loci of a gene through interactions", response: Neighborhood{}, query: []string{"celltype", "depth"}})
+}
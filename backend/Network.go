@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Gene networks
+Two genes are connected in a cell type when they are in different anchors of
+the same interaction of that cell type. The weight of the connection is the
+number of such interactions. Each edge is listed once, with Source < Target.
+**/
+
+type GeneEdge struct {
+	Source string `json:"Source" db:"Source"`
+	Target string `json:"Target" db:"Target"`
+	Weight int    `json:"Weight" db:"Weight"`
+	// Expression levels in the cell type, or null if none is known.
+	SourceExpression *float64 `json:"SourceExpression" db:"SourceExpression"`
+	TargetExpression *float64 `json:"TargetExpression" db:"TargetExpression"`
+}
+
+var geneEdgeList = ListSpec{
+	Fields: map[string]ListField{
+		"source":           {"Source", fieldString},
+		"target":           {"Target", fieldString},
+		"weight":           {"Weight", fieldInt},
+		"sourceexpression": {"SourceExpression", fieldFloat},
+		"targetexpression": {"TargetExpression", fieldFloat},
+	},
+	Named: map[string]NamedFilter{
+		"minweight": {"weight", ">="},
+	},
+	Order:  "Source, Target",
+	Params: []string{"minExpression"},
+}
+
+/*
+Selects the edges of the gene network of a cell type, the first argument. When
+filtering by expression, both genes must be expressed at least at the levels
+given as the second and third arguments.
+*/
+func geneNetworkQuery(byExpression bool) string {
+	query := `SELECT GA.Gene AS Source, GB.Gene AS Target, COUNT(DISTINCT I.ID) AS Weight,
+		EA.ExpressionLevel AS SourceExpression, EB.ExpressionLevel AS TargetExpression
+		FROM Interactions AS I
+		INNER JOIN InteractionParticipation AS PA ON PA.Interaction=I.ID
+		INNER JOIN InteractionParticipation AS PB ON PB.Interaction=I.ID AND PB.Locus<>PA.Locus
+		INNER JOIN GeneInLocus AS GA ON GA.Locus=PA.Locus
+		INNER JOIN GeneInLocus AS GB ON GB.Locus=PB.Locus
+		LEFT JOIN GeneExpression AS EA ON EA.Gene=GA.Gene AND EA.CellType=I.CellType
+		LEFT JOIN GeneExpression AS EB ON EB.Gene=GB.Gene AND EB.CellType=I.CellType
+		WHERE I.CellType=? AND GA.Gene < GB.Gene`
+	if byExpression {
+		query += ` AND EA.ExpressionLevel >= ? AND EB.ExpressionLevel >= ?`
+	}
+	return query + ` GROUP BY GA.Gene, GB.Gene`
+}
+
+func (e GeneEdge) Formats() []string {
+	return []string{formatTSV}
+}
+
+func (e GeneEdge) Header(format string) []string {
+	return []string{"Source", "Target", "Weight", "SourceExpression", "TargetExpression"}
+}
+
+func (e GeneEdge) Rows(format string) ([][]string, error) {
+	return [][]string{{e.Source, e.Target, strconv.Itoa(e.Weight), optionalFloat(e.SourceExpression), optionalFloat(e.TargetExpression)}}, nil
+}
+
+/** HTTP Routes **/
+
+func handleGetGeneNetwork(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+
+	raw := r.URL.Query().Get("minExpression")
+	if raw == "" {
+		serveList[GeneEdge](w, r, geneEdgeList, "Gene Network", geneNetworkQuery(false), cell.Type)
+		return
+	}
+
+	minExpression, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "minExpression must be a number.")
+		return
+	}
+	serveList[GeneEdge](w, r, geneEdgeList, "Gene Network", geneNetworkQuery(true), cell.Type, minExpression, minExpression)
+}
+
+func init() {
+	registerRoute(Route{path: "/celltypes/{type}/network", handler: handleGetGeneNetwork, method: "GET",
+		summary:  "List the gene to gene connections of a cell type, weighted by their number of interactions",
+		response: []GeneEdge{}, list: &geneEdgeList, query: []string{"minExpression"}})
+}
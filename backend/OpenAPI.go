@@ -0,0 +1,280 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+OpenAPI
+The document served at /api/openapi.json is generated from the route registry.
+Schemas come from the json tags of the types given as a route's body and
+response, so they cannot drift from what the handlers actually read and write.
+A small docs page reading the document is served at /api/docs.
+**/
+
+const apiTitle = "4620 Genomics Database"
+const apiVersion = "1.0.0"
+
+// JSON objects of the document, kept as maps since their shape varies so much.
+type object map[string]interface{}
+
+var pathParamPattern = regexp.MustCompile(`{([^}]+)}`)
+
+//go:embed docs.html
+var docsPage []byte
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// Collects the schemas of every named type referenced by the document.
+type schemaRegistry struct {
+	schemas object
+}
+
+// Returns the schema of a type, adding structs to the registry and referencing them by name.
+func (s schemaRegistry) schemaFor(t reflect.Type) object {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.schemaFor(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Uint8:
+		// Single characters, such as MotifModel.Quality, are sent as their byte value.
+		return object{"type": "integer", "minimum": 0, "maximum": 255}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint16, reflect.Uint32:
+		return object{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return object{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number", "format": "double"}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		ref := object{"$ref": "#/components/schemas/" + t.Name()}
+		if _, seen := s.schemas[t.Name()]; seen {
+			return ref
+		}
+		// Registered before the fields are read, so recursive types terminate.
+		s.schemas[t.Name()] = object{}
+		s.schemas[t.Name()] = s.structSchema(t)
+		return ref
+	}
+	return object{}
+}
+
+func (s schemaRegistry) structSchema(t reflect.Type) object {
+	properties := object{}
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		// Embedded structs without a name of their own are flattened, as encoding/json does.
+		if name == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded := s.structSchema(field.Type)
+			for key, value := range embedded["properties"].(object) {
+				properties[key] = value
+			}
+			if fields, ok := embedded["required"].([]string); ok {
+				required = append(required, fields...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schemaFor(field.Type)
+		if len(tag) < 2 || tag[1] != "omitempty" {
+			required = append(required, name)
+		}
+	}
+
+	// A field may shadow one of an embedded struct, and is only required once.
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(required))
+	for _, name := range required {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	schema := object{"type": "object", "properties": properties}
+	if len(unique) > 0 {
+		schema["required"] = unique
+	}
+	return schema
+}
+
+// Describes the query parameters of a list, see List.go.
+func listParameters(spec ListSpec) []object {
+	params := []object{
+		{"name": "limit", "in": "query", "schema": object{"type": "integer", "minimum": 1}, "description": "Maximum number of items to return."},
+		{"name": "offset", "in": "query", "schema": object{"type": "integer", "minimum": 0}, "description": "Number of items to skip."},
+		{"name": "sort", "in": "query", "schema": object{"type": "string"}, "description": "Comma separated fields to sort by, prefixed with - for descending."},
+		{"name": "format", "in": "query", "schema": object{"type": "string"}, "description": "Response format, overriding the Accept header."},
+	}
+
+	names := make([]string, 0, len(spec.Fields))
+	for name := range spec.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params = append(params, object{
+			"name":        name,
+			"in":          "query",
+			"schema":      object{"type": "string"},
+			"description": "Filter, given as " + name + "=value or with one of !=, <, <=, > or >=.",
+		})
+	}
+
+	named := make([]string, 0, len(spec.Named))
+	for name := range spec.Named {
+		named = append(named, name)
+	}
+	sort.Strings(named)
+	for _, name := range named {
+		params = append(params, object{
+			"name":        name,
+			"in":          "query",
+			"schema":      object{"type": "string"},
+			"description": "Filter, keeping items with " + spec.Named[name].Field + " " + spec.Named[name].Op + " the value.",
+		})
+	}
+	return params
+}
+
+// The media types a list of the given element type can be returned as.
+func listContent(element reflect.Type, schema object) object {
+	content := object{
+		formatMediaTypes[formatJSON]:   object{"schema": schema},
+		formatMediaTypes[formatNDJSON]: object{"schema": schema["items"]},
+	}
+	if t, ok := reflect.Zero(element).Interface().(tabular); ok {
+		for _, format := range t.Formats() {
+			content[formatMediaTypes[format]] = object{"schema": object{"type": "string"}}
+		}
+	}
+	return content
+}
+
+func (s schemaRegistry) operation(rt Route) object {
+	op := object{"summary": rt.summary}
+
+	params := make([]object, 0)
+	for _, match := range pathParamPattern.FindAllStringSubmatch(rt.path, -1) {
+		params = append(params, object{"name": match[1], "in": "path", "required": true, "schema": object{"type": "string"}})
+	}
+	for _, name := range rt.query {
+		params = append(params, object{"name": name, "in": "query", "schema": object{"type": "string"}})
+	}
+	if rt.list != nil {
+		params = append(params, listParameters(*rt.list)...)
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if rt.body != nil {
+		op["requestBody"] = object{
+			"required": true,
+			"content":  object{"application/json": object{"schema": s.schemaFor(reflect.TypeOf(rt.body))}},
+		}
+	}
+
+	status := "200"
+	if rt.method == "POST" {
+		status = "201"
+	}
+	success := object{"description": "Success"}
+	if rt.response != nil {
+		t := reflect.TypeOf(rt.response)
+		schema := s.schemaFor(t)
+		if rt.list != nil {
+			success["content"] = listContent(t.Elem(), schema)
+			success["headers"] = object{"X-Total-Count": object{
+				"description": "Number of items matching the filters, ignoring limit and offset. Not sent with streamed formats.",
+				"schema":      object{"type": "integer"},
+			}}
+		} else {
+			success["content"] = object{"application/json": object{"schema": schema}}
+		}
+	}
+
+	op["responses"] = object{
+		status: success,
+		"default": object{
+			"description": "Error",
+			"content":     object{"application/problem+json": object{"schema": s.schemaFor(reflect.TypeOf(Problem{}))}},
+		},
+	}
+	return op
+}
+
+// Builds the OpenAPI 3 document describing every registered route.
+func BuildOpenAPI() object {
+	s := schemaRegistry{schemas: object{}}
+	paths := object{}
+	for _, rt := range routes {
+		path, ok := paths[rt.path].(object)
+		if !ok {
+			path = object{}
+			paths[rt.path] = path
+		}
+		path[strings.ToLower(rt.method)] = s.operation(rt)
+	}
+
+	return object{
+		"openapi":    "3.0.3",
+		"info":       object{"title": apiTitle, "version": apiVersion},
+		"servers":    []object{{"url": "/api"}},
+		"paths":      paths,
+		"components": object{"schemas": s.schemas},
+	}
+}
+
+/** HTTP Routes **/
+
+func handleGetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	// Routes are all registered at init, so the document never changes while serving.
+	openAPIOnce.Do(func() {
+		openAPIDocument, _ = json.Marshal(BuildOpenAPI())
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func handleGetDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+func init() {
+	registerRoute(Route{path: "/openapi.json", handler: handleGetOpenAPI, method: "GET",
+		summary: "The OpenAPI 3 document describing this API"})
+	registerRoute(Route{path: "/docs", handler: handleGetDocs, method: "GET",
+		summary: "Browsable documentation of this API"})
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Promoters
+The promoter of a gene is a window around its transcription start site (TSS),
+reaching Upstream bases against the direction of transcription and Downstream
+bases along it. The default window is read from the PROMOTER_UPSTREAM and
+PROMOTER_DOWNSTREAM environment variables, and can be overridden per request.
+Each anchor of an interaction is classified as:
+  promoter  overlapping the promoter of some gene,
+  genebody  otherwise, overlapping the body of some gene,
+  distal    otherwise.
+An interaction is classified by the classes of its anchors, in that order and
+joined by "-", such as "promoter-distal" or "promoter-promoter".
+**/
+
+const (
+	anchorPromoter = "promoter"
+	anchorGeneBody = "genebody"
+	anchorDistal   = "distal"
+)
+
+// Anchor classes in the order they appear in the class of an interaction.
+var anchorClassOrder = map[string]int{anchorPromoter: 0, anchorGeneBody: 1, anchorDistal: 2}
+
+const defaultPromoterUpstream = 2000
+const defaultPromoterDownstream = 500
+
+type PromoterWindow struct {
+	Upstream   int `json:"Upstream"`
+	Downstream int `json:"Downstream"`
+}
+
+// Reads the default promoter window from the environment, warning about invalid values.
+func promoterWindowFromEnv() PromoterWindow {
+	w := PromoterWindow{defaultPromoterUpstream, defaultPromoterDownstream}
+	for _, setting := range []struct {
+		env   string
+		value *int
+	}{{"PROMOTER_UPSTREAM", &w.Upstream}, {"PROMOTER_DOWNSTREAM", &w.Downstream}} {
+		raw, set := os.LookupEnv(setting.env)
+		if !set {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			fmt.Printf("[Warn] Ignoring %s, which must be a non-negative integer.\n", setting.env)
+			continue
+		}
+		*setting.value = parsed
+	}
+	return w
+}
+
+// The promoter region of a gene, clipped to the start of its chromosome.
+func (w PromoterWindow) Promoter(g Gene) Region {
+	r := Region{Chr: g.Chr, Strand: g.Strand}
+	if g.Strand == "-" {
+		r.Start, r.End = g.End-w.Downstream, g.End+w.Upstream
+	} else {
+		r.Start, r.End = g.Start-w.Upstream, g.Start+w.Downstream
+	}
+	if r.Start < 0 {
+		r.Start = 0
+	}
+	return r
+}
+
+// How far a promoter can reach outside of its gene.
+func (w PromoterWindow) reach() int {
+	if w.Upstream > w.Downstream {
+		return w.Upstream
+	}
+	return w.Downstream
+}
+
+// An anchor locus with its class, and the genes it overlaps the promoter or body of.
+type AnchorAnnotation struct {
+	Locus
+	Class      string   `json:"Class"`
+	Promoters  []string `json:"Promoters"`
+	GeneBodies []string `json:"GeneBodies"`
+}
+
+// An interaction with its anchors classified.
+type ClassifiedInteraction struct {
+	Interaction
+	Class string             `json:"Class"`
+	Loci  []AnchorAnnotation `json:"Loci"`
+}
+
+/*
+Genes by chromosome, sorted by start, so the genes near a locus are found
+without a query per locus.
+*/
+type geneIndex map[string]*chrGenes
+
+type chrGenes struct {
+	genes []Gene
+	// The length of the longest gene, bounding how far before a locus a gene overlapping it can start.
+	longest int
+}
+
+func loadGeneIndex(chrs []string) (geneIndex, error) {
+	index := make(geneIndex)
+	err := eachInChunk(chrs, func(args []interface{}) error {
+		rows, err := db.Queryx(fmt.Sprintf(`SELECT * FROM Genes WHERE Chr IN (%s)`, placeholders(len(args))), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var g Gene
+			err = rows.StructScan(&g)
+			if err != nil {
+				return err
+			}
+			c := index[g.Chr]
+			if c == nil {
+				c = &chrGenes{}
+				index[g.Chr] = c
+			}
+			c.genes = append(c.genes, g)
+			if g.End-g.Start > c.longest {
+				c.longest = g.End - g.Start
+			}
+		}
+		return rows.Err()
+	})
+
+	for _, c := range index {
+		genes := c.genes
+		sort.Slice(genes, func(i, j int) bool { return genes[i].Start < genes[j].Start })
+	}
+	return index, err
+}
+
+/*
+The genes of a chromosome whose body or promoter may overlap a locus: those
+starting before the end of the locus plus the reach of a promoter, and after
+its start minus that reach and the length of the longest gene.
+*/
+func (index geneIndex) near(l Locus, w PromoterWindow) []Gene {
+	c := index[l.Chr]
+	if c == nil {
+		return nil
+	}
+	genes := c.genes
+	first := sort.Search(len(genes), func(i int) bool { return genes[i].Start+c.longest+w.reach() > l.Start })
+	limit := sort.Search(len(genes), func(i int) bool { return genes[i].Start >= l.End+w.reach() })
+	if limit < first {
+		return nil
+	}
+	return genes[first:limit]
+}
+
+// Intervals are half-open, as everywhere else, so empty ones overlap nothing.
+func overlaps(aStart int, aEnd int, bStart int, bEnd int) bool {
+	return aStart < bEnd && bStart < aEnd && aStart < aEnd && bStart < bEnd
+}
+
+func (index geneIndex) classify(l Locus, w PromoterWindow) AnchorAnnotation {
+	a := AnchorAnnotation{Locus: l, Promoters: make([]string, 0), GeneBodies: make([]string, 0)}
+
+	for _, g := range index.near(l, w) {
+		promoter := w.Promoter(g)
+		if overlaps(l.Start, l.End, promoter.Start, promoter.End) {
+			a.Promoters = append(a.Promoters, g.Name)
+		}
+		if overlaps(l.Start, l.End, g.Start, g.End) {
+			a.GeneBodies = append(a.GeneBodies, g.Name)
+		}
+	}
+
+	switch {
+	case len(a.Promoters) > 0:
+		a.Class = anchorPromoter
+	case len(a.GeneBodies) > 0:
+		a.Class = anchorGeneBody
+	default:
+		a.Class = anchorDistal
+	}
+	return a
+}
+
+// Classifies every anchor of the interactions, which must have their loci filled in.
+func ClassifyInteractions(its []Interaction, w PromoterWindow) ([]ClassifiedInteraction, error) {
+	seen := make(map[string]bool)
+	chrs := make([]string, 0)
+	for _, it := range its {
+		for _, l := range it.Loci {
+			if !seen[l.Chr] {
+				seen[l.Chr] = true
+				chrs = append(chrs, l.Chr)
+			}
+		}
+	}
+	index, err := loadGeneIndex(chrs)
+	if err != nil {
+		return nil, err
+	}
+
+	classified := make([]ClassifiedInteraction, len(its))
+	for i, it := range its {
+		c := ClassifiedInteraction{Interaction: it, Loci: make([]AnchorAnnotation, len(it.Loci))}
+		classes := make([]string, len(it.Loci))
+		for j, l := range it.Loci {
+			c.Loci[j] = index.classify(l, w)
+			classes[j] = c.Loci[j].Class
+		}
+		sort.Slice(classes, func(x, y int) bool { return anchorClassOrder[classes[x]] < anchorClassOrder[classes[y]] })
+		c.Class = strings.Join(classes, "-")
+		c.Interaction.Loci = nil
+		classified[i] = c
+	}
+	return classified, nil
+}
+
+// Whether an interaction has an anchor overlapping the promoter of the gene.
+func (c ClassifiedInteraction) targets(gene string) bool {
+	for _, a := range c.Loci {
+		for _, name := range a.Promoters {
+			if name == gene {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Returns the classified interactions of a cell type. When class is given only
+interactions of that class are kept, and when gene is given only those with an
+anchor on its promoter.
+*/
+func (c CellType) GetClassifiedInteractions(w PromoterWindow, class string, gene *Gene) ([]ClassifiedInteraction, error) {
+	where := "I.CellType=?"
+	args := []interface{}{c.Type}
+	if gene != nil {
+		// Interactions without an anchor on the promoter are left out before classifying.
+		promoter := w.Promoter(*gene)
+		clause, overlapArgs := overlapClause("PL", "PL.End", promoter.Chr, promoter.Start, promoter.End)
+		where += ` AND I.ID IN (SELECT PP.Interaction FROM InteractionParticipation AS PP
+			INNER JOIN Loci AS PL ON PL.ID=PP.Locus WHERE ` + clause + `)`
+		args = append(args, overlapArgs...)
+	}
+
+	rows, err := db.Queryx(interactionsQuery(where, "")+" ORDER BY I.ID", args...)
+	if err != nil {
+		return nil, err
+	}
+	its := make([]Interaction, 0)
+	for rows.Next() {
+		var it Interaction
+		err = rows.StructScan(&it)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	rows.Close()
+
+	err = fillInteractionLoci(its)
+	if err != nil {
+		return nil, err
+	}
+	classified, err := ClassifyInteractions(its, w)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]ClassifiedInteraction, 0, len(classified))
+	for _, ci := range classified {
+		if (class == "" || ci.Class == class) && (gene == nil || ci.targets(gene.Name)) {
+			kept = append(kept, ci)
+		}
+	}
+	return kept, nil
+}
+
+/** HTTP Routes **/
+
+// Paging only, as classified interactions are filtered after they are read.
+var classifiedInteractionList = ListSpec{
+	Fields: map[string]ListField{},
+	Params: []string{"class", "gene", "upstream", "downstream"},
+}
+
+// Reads the promoter window of a request, starting from the default of the environment.
+func parsePromoterWindow(r *http.Request) (PromoterWindow, error) {
+	w := promoterWindowFromEnv()
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"upstream", &w.Upstream}, {"downstream", &w.Downstream}} {
+		raw := r.URL.Query().Get(param.name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return w, fmt.Errorf("%s must be a non-negative integer", param.name)
+		}
+		*param.value = parsed
+	}
+	return w, nil
+}
+
+/*
+Reads the class of an interaction, in any order and case, as ClassifyInteractions
+writes it, so "distal-promoter" is "promoter-distal". An empty class filters nothing.
+*/
+func parseInteractionClass(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	parts := strings.Split(strings.ToLower(raw), "-")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("class must be the classes of at least two anchors joined by -, such as promoter-distal")
+	}
+	for _, part := range parts {
+		if _, ok := anchorClassOrder[part]; !ok {
+			return "", fmt.Errorf("class must be anchor classes joined by -, such as promoter-distal, not %q", raw)
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return anchorClassOrder[parts[i]] < anchorClassOrder[parts[j]] })
+	return strings.Join(parts, "-"), nil
+}
+
+func handleGetClassifiedInteractions(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+
+	p, err := ParseListParams(r, classifiedInteractionList)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+	window, err := parsePromoterWindow(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	class, err := parseInteractionClass(r.URL.Query().Get("class"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	var gene *Gene
+	if name := r.URL.Query().Get("gene"); name != "" {
+		g, err := GetGene(name)
+		if err != nil {
+			writeError(w, err, "Could not fetch Genes.")
+			return
+		}
+		gene = &g
+	}
+
+	classified, err := cell.GetClassifiedInteractions(window, class, gene)
+	if err != nil {
+		writeError(w, err, "Could not classify Interactions.")
+		return
+	}
+
+	servePage(w, p, classified)
+}
+
+func handleGetPromoter(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	gene, err := GetGene(v["name"])
+	if err != nil {
+		writeError(w, err, "Could not fetch Genes.")
+		return
+	}
+	window, err := parsePromoterWindow(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(window.Promoter(gene))
+}
+
+func init() {
+	registerRoute(Route{path: "/celltypes/{type}/interactions/classified", handler: handleGetClassifiedInteractions, method: "GET",
+		summary:  "List the interactions of a cell type with their anchors classified as promoter, genebody or distal",
+		response: []ClassifiedInteraction{}, query: []string{"class", "gene", "upstream", "downstream", "limit", "offset"}})
+	registerRoute(Route{path: "/genes/{name}/promoter", handler: handleGetPromoter, method: "GET",
+		summary: "Get the promoter region of a gene", response: Region{}, query: []string{"upstream", "downstream"}})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseInteractionClass(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"promoter-distal", "promoter-distal", false},
+		{"distal-promoter", "promoter-distal", false},
+		{"genebody-promoter", "promoter-genebody", false},
+		{"Distal-GeneBody-Promoter", "promoter-genebody-distal", false},
+		{"distal-distal", "distal-distal", false},
+		{"promoter", "", true},
+		{"promoter-enhancer", "", true},
+		{"promoter-", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseInteractionClass(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseInteractionClass(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseInteractionClass(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+// Classifying through the index must agree with looking at every gene.
+func TestGeneIndexClassify(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	genes := make([]Gene, 200)
+	for i := range genes {
+		start := rng.Intn(100000)
+		length := 1 + rng.Intn(200)
+		if i%50 == 0 {
+			length = 20000
+		}
+		strand := "+"
+		if rng.Intn(2) == 0 {
+			strand = "-"
+		}
+		genes[i] = Gene{Name: string(rune('A'+i%26)) + string(rune('a'+i/26)), Chr: "chr1", Start: start, End: start + length, Strand: strand}
+	}
+	c := &chrGenes{genes: append([]Gene(nil), genes...)}
+	for _, g := range genes {
+		if g.End-g.Start > c.longest {
+			c.longest = g.End - g.Start
+		}
+	}
+	sort.Slice(c.genes, func(i, j int) bool { return c.genes[i].Start < c.genes[j].Start })
+	index := geneIndex{"chr1": c}
+	w := PromoterWindow{Upstream: 2000, Downstream: 500}
+
+	for i := 0; i < 500; i++ {
+		start := rng.Intn(105000)
+		l := Locus{Chr: "chr1", Start: start, End: start + 1 + rng.Intn(5000)}
+		got := index.classify(l, w)
+
+		promoters, bodies := make([]string, 0), make([]string, 0)
+		for _, g := range c.genes {
+			p := w.Promoter(g)
+			if overlaps(l.Start, l.End, p.Start, p.End) {
+				promoters = append(promoters, g.Name)
+			}
+			if overlaps(l.Start, l.End, g.Start, g.End) {
+				bodies = append(bodies, g.Name)
+			}
+		}
+		if !reflect.DeepEqual(got.Promoters, promoters) || !reflect.DeepEqual(got.GeneBodies, bodies) {
+			t.Fatalf("classify(%d-%d) = %v, %v, want %v, %v", l.Start, l.End, got.Promoters, got.GeneBodies, promoters, bodies)
+		}
+	}
+
+	if a := index.classify(Locus{Chr: "chr2", Start: 0, End: 100}, w); a.Class != anchorDistal {
+		t.Errorf("class on a chromosome without genes = %s, want %s", a.Class, anchorDistal)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Region
+A genomic interval, optionally stranded. Coordinates are half-open, so
+"chrX:1000-2000" covers bases 1000 through 1999.
+Accepted inputs include "chrX:1000-2000", "X:1,000-2,000", "chrX:1000-2000:+"
+and "chrX:1000-2000(-)". The canonical form always uses the "chr" prefix.
+*/
+type Region struct {
+	Chr    string `json:"Chr"`
+	Start  int    `json:"Start"`
+	End    int    `json:"End"`
+	Strand string `json:"Strand,omitempty"`
+}
+
+// Returned for any region which cannot be parsed or is out of bounds.
+type RegionError struct {
+	Input  string
+	Reason string
+}
+
+func (e RegionError) Error() string {
+	return fmt.Sprintf("invalid region \"%s\": %s", e.Input, e.Reason)
+}
+
+func (e RegionError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Names given without a prefix which are known to be chromosomes.
+var unprefixedChromosomes = map[string]string{"X": "X", "Y": "Y", "M": "M", "MT": "M"}
+
+/*
+Puts a chromosome name in its canonical form. Aliases of the active assembly
+resolve to its own names; otherwise names become "chrN" and scaffolds are kept as is.
+*/
+func normalizeChrName(chr string) string {
+	if name, ok := activeAssembly.resolve(chr); ok {
+		return name
+	}
+	if len(chr) > 3 && strings.EqualFold(chr[:3], "chr") {
+		return "chr" + chr[3:]
+	}
+	if name, ok := unprefixedChromosomes[strings.ToUpper(chr)]; ok {
+		return "chr" + name
+	}
+	if _, err := strconv.Atoi(chr); err == nil {
+		return "chr" + chr
+	}
+	return chr
+}
+
+// Builds a validated region, normalizing the chromosome name.
+func NewRegion(chr string, start int, end int) (Region, error) {
+	r := Region{Chr: normalizeChrName(strings.TrimSpace(chr)), Start: start, End: end}
+	err := r.Validate()
+	return r, err
+}
+
+func (r Region) Validate() error {
+	if r.Chr == "" {
+		return RegionError{r.String(), "chromosome is missing"}
+	}
+	if strings.ContainsAny(r.Chr, ":- \t") {
+		return RegionError{r.String(), "chromosome contains invalid characters"}
+	}
+	if r.Start < 0 {
+		return RegionError{r.String(), "start must not be negative"}
+	}
+	if r.Start >= r.End {
+		return RegionError{r.String(), "start must be less than end"}
+	}
+	if r.Strand != "" && r.Strand != "+" && r.Strand != "-" {
+		return RegionError{r.String(), "strand must be + or -"}
+	}
+	return activeAssembly.check(r)
+}
+
+// Parses any accepted form of region, returning it in canonical form.
+func ParseRegion(input string) (Region, error) {
+	s := strings.TrimSpace(input)
+
+	strand := ""
+	for _, suffix := range []string{":+", ":-", "(+)", "(-)"} {
+		if strings.HasSuffix(s, suffix) {
+			strand = strings.Trim(suffix, ":()")
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+
+	colonPos := strings.LastIndex(s, ":")
+	if colonPos < 1 {
+		return Region{}, RegionError{input, "must be of the form chr:start-end"}
+	}
+
+	bounds := strings.Split(strings.ReplaceAll(s[colonPos+1:], ",", ""), "-")
+	if len(bounds) != 2 {
+		return Region{}, RegionError{input, "must be of the form chr:start-end"}
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+	if err != nil {
+		return Region{}, RegionError{input, "start must be an integer"}
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64)
+	if err != nil {
+		return Region{}, RegionError{input, "end must be an integer"}
+	}
+
+	r, err := NewRegion(s[:colonPos], int(start), int(end))
+	if err != nil {
+		return Region{}, RegionError{input, err.(RegionError).Reason}
+	}
+	r.Strand = strand
+	return r, nil
+}
+
+// The canonical ID of the region, as used for Loci. Strand is not included.
+func (r Region) ID() string {
+	return fmt.Sprintf("%s:%d-%d", r.Chr, r.Start, r.End)
+}
+
+// The canonical form of the region, which ParseRegion reads back unchanged.
+func (r Region) String() string {
+	if r.Strand != "" {
+		return r.ID() + ":" + r.Strand
+	}
+	return r.ID()
+}
+
+func (r Region) Locus() Locus {
+	return Locus{ID: r.ID(), Chr: r.Chr, Start: r.Start, End: r.End}
+}
+
+func (l Locus) Region() Region {
+	return Region{Chr: l.Chr, Start: l.Start, End: l.End}
+}
+
+/*
+Checks a locus from a client, filling in whichever of the ID or coordinates
+are missing and putting the ID in canonical form.
+*/
+func (l Locus) Normalize() (Locus, error) {
+	if l.ID == "" {
+		r, err := NewRegion(l.Chr, l.Start, l.End)
+		return r.Locus(), err
+	}
+
+	r, err := ParseRegion(l.ID)
+	if err != nil {
+		return Locus{}, err
+	}
+	if l.Chr != "" || l.Start != 0 || l.End != 0 {
+		given, err := NewRegion(l.Chr, l.Start, l.End)
+		if err != nil || given.ID() != r.ID() {
+			return Locus{}, RegionError{l.ID, "ID does not match the Chr, Start and End of the Locus"}
+		}
+	}
+	return r.Locus(), nil
+}
+
+// Parses a locus ID given to a handler, writing a 400 response if it is invalid.
+func parseLocusID(w http.ResponseWriter, id string) (string, bool) {
+	r, err := ParseRegion(id)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_region", "Invalid Locus ID: "+err.Error())
+		return "", false
+	}
+	return r.ID(), true
+}
+
+// Everything found inside of a genomic interval, grouped by entity type.
+type RegionContents struct {
+	Loci           []Locus         `json:"Loci"`
+	Genes          []Gene          `json:"Genes"`
+	MotifInstances []MotifInstance `json:"MotifInstances"`
+}
+
+/** SQL Helpers **/
+
+// Intervals are treated as half-open, so touching intervals do not overlap.
+func GetLociInRegion(chr string, start int, end int) (loci []Locus, err error) {
+	clause, args := overlapClause("", "End", chr, start, end)
+	query := `SELECT * FROM Loci WHERE ` + clause
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return []Locus{}, err
+	}
+	defer rows.Close()
+
+	loci = make([]Locus, 0)
+	for rows.Next() {
+		var l Locus
+		err = rows.StructScan(&l)
+		if err != nil {
+			return loci, err
+		}
+		loci = append(loci, l)
+	}
+
+	return
+}
+
+func GetGenesInRegion(chr string, start int, end int) (genes []Gene, err error) {
+	clause, args := overlapClause("", "End", chr, start, end)
+	query := `SELECT * FROM Genes WHERE ` + clause
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return []Gene{}, err
+	}
+	defer rows.Close()
+
+	genes = make([]Gene, 0)
+	for rows.Next() {
+		var g Gene
+		err = rows.StructScan(&g)
+		if err != nil {
+			return genes, err
+		}
+		genes = append(genes, g)
+	}
+
+	return
+}
+
+// A motif instance covers Start to Start + Length of its model.
+// An empty cell type matches instances of every cell type.
+func GetMotifInstancesInRegion(chr string, start int, end int, celltype string) (instances []MotifInstance, err error) {
+	clause, args := overlapClause("MI", "MI.Start + MM.Length", chr, start, end)
+	query := `SELECT MI.* FROM MotifInstances AS MI INNER JOIN MotifModels AS MM ON MI.Model=MM.Name
+		WHERE ` + clause + ` AND (? = '' OR MI.CellType=?)`
+	rows, err := db.Queryx(query, append(args, celltype, celltype)...)
+	if err != nil {
+		return []MotifInstance{}, err
+	}
+	defer rows.Close()
+
+	instances = make([]MotifInstance, 0)
+	for rows.Next() {
+		var mi MotifInstance
+		err = rows.StructScan(&mi)
+		if err != nil {
+			return instances, err
+		}
+		instances = append(instances, mi)
+	}
+
+	return
+}
+
+// A gene with the number of bases between it and a region, 0 when they overlap or touch.
+type GeneDistance struct {
+	Gene
+	Distance int `json:"Distance"`
+}
+
+func regionDistance(r Region, start int, end int) int {
+	switch {
+	case end < r.Start:
+		return r.Start - end
+	case start > r.End:
+		return start - r.End
+	}
+	return 0
+}
+
+const maxNearestGenes = 100
+
+/*
+Returns the k genes nearest to a region, nearest first. Genes are looked up in
+a window around the region, through the interval index, which doubles from one
+bin of the first level until it holds k genes nearer than its edges, or every
+gene of the chromosome.
+*/
+func GetNearestGenes(region Region, k int) ([]GeneDistance, error) {
+	var extent struct {
+		Count int `db:"Count"`
+		Start int `db:"Start"`
+		End   int `db:"End"`
+	}
+	err := db.Get(&extent, `SELECT COUNT(*) AS Count, IFNULL(MIN(Start), 0) AS Start, IFNULL(MAX(End), 0) AS End FROM Genes WHERE Chr=?`, region.Chr)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]GeneDistance, 0)
+	for window := 1 << binFirstShift; extent.Count > 0; window *= 2 {
+		genes, err := GetGenesInRegion(region.Chr, region.Start-window, region.End+window)
+		if err != nil {
+			return nil, err
+		}
+		found = make([]GeneDistance, len(genes))
+		for i, g := range genes {
+			found[i] = GeneDistance{g, regionDistance(region, g.Start, g.End)}
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].Distance != found[j].Distance {
+				return found[i].Distance < found[j].Distance
+			}
+			return found[i].Start < found[j].Start
+		})
+
+		// Genes outside of the window are at least window bases away.
+		if len(found) >= k && found[k-1].Distance < window {
+			break
+		}
+		if region.Start-window <= extent.Start && region.End+window >= extent.End {
+			break
+		}
+	}
+
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found, nil
+}
+
+func GetRegionContents(region Region, celltype string) (contents RegionContents, err error) {
+	contents.Loci, err = GetLociInRegion(region.Chr, region.Start, region.End)
+	if err != nil {
+		return
+	}
+	contents.Genes, err = GetGenesInRegion(region.Chr, region.Start, region.End)
+	if err != nil {
+		return
+	}
+	contents.MotifInstances, err = GetMotifInstancesInRegion(region.Chr, region.Start, region.End, celltype)
+	return
+}
+
+/** HTTP Routes **/
+
+func handleGetRegion(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	region, err := ParseRegion(v["region"])
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_region", err.Error())
+		return
+	}
+
+	celltype := r.URL.Query().Get("celltype")
+	if celltype != "" {
+		_, err = GetCellType(celltype)
+		if err != nil {
+			writeError(w, err, "Unable to fetch Cell Type.")
+			return
+		}
+	}
+
+	contents, err := GetRegionContents(region, celltype)
+	if err != nil {
+		writeError(w, err, "Could not fetch contents of region.")
+		return
+	}
+
+	json.NewEncoder(w).Encode(contents)
+}
+
+func handleGetNearestGenes(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	region, err := ParseRegion(v["region"])
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_region", err.Error())
+		return
+	}
+
+	k := 1
+	if raw := r.URL.Query().Get("k"); raw != "" {
+		k, err = strconv.Atoi(raw)
+		if err != nil || k < 1 || k > maxNearestGenes {
+			writeProblem(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("k must be an integer from 1 to %d.", maxNearestGenes))
+			return
+		}
+	}
+
+	genes, err := GetNearestGenes(region, k)
+	if err != nil {
+		writeError(w, err, "Could not fetch Genes.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(genes)
+}
+
+func init() {
+	registerRoute(Route{path: "/regions/{region}", handler: handleGetRegion, method: "GET",
+		summary: "Get the loci, genes and motif instances in a region", response: RegionContents{}, query: []string{"celltype"}})
+	registerRoute(Route{path: "/regions/{region}/nearestgenes", handler: handleGetNearestGenes, method: "GET",
+		summary: "Get the k genes nearest to a region, with their distance to it", response: []GeneDistance{}, query: []string{"k"}})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/**
+Sequences
+Loci and Motif Instances are returned with their sequence in the genome of
+GENOME_FASTA (see Genome.go), read through its .fai index, as JSON or, with
+format=fasta or Accept: text/x-fasta, as FASTA wrapped at 60 bases. Lists of
+them can also be streamed as NDJSON.
+A Motif Instance spans Start to Start plus the Length of its model, and is
+reverse-complemented when not Forward, so it reads along the motif. Its FASTA
+name is "model::chr:start-end(strand)", as bedtools getfasta -name writes it.
+**/
+
+const fastaLineWidth = 60
+
+type SequenceRecord struct {
+	Name string `json:"Name"`
+	Region
+	Sequence string `json:"Sequence"`
+}
+
+var complementBases = func() (complement [256]byte) {
+	for i := range complement {
+		complement[i] = 'N'
+	}
+	for _, pair := range []string{"AT", "TA", "CG", "GC"} {
+		complement[pair[0]] = pair[1]
+	}
+	return
+}()
+
+// Reverse-complements upper case bases, anything other than A, C, G and T becoming N.
+func reverseComplement(seq []byte) []byte {
+	rc := make([]byte, len(seq))
+	for i, b := range seq {
+		rc[len(seq)-1-i] = complementBases[b]
+	}
+	return rc
+}
+
+func (g *Genome) LocusSequence(l Locus) (SequenceRecord, error) {
+	seq, err := g.Sequence(l.Chr, l.Start, l.End)
+	if err != nil {
+		return SequenceRecord{}, err
+	}
+	return SequenceRecord{Name: l.ID, Region: l.Region(), Sequence: string(seq)}, nil
+}
+
+// The sequence of a Motif Instance, whose Length must be that of its model.
+func (g *Genome) MotifInstanceSequence(m MotifInstance) (SequenceRecord, error) {
+	r := Region{Chr: m.Chr, Start: m.Start, End: m.Start + m.Length, Strand: strandOf(m.Forward)}
+	seq, err := g.Sequence(r.Chr, r.Start, r.End)
+	if err != nil {
+		return SequenceRecord{}, err
+	}
+	if !m.Forward {
+		seq = reverseComplement(seq)
+	}
+	name := fmt.Sprintf("%s::%s(%s)", m.Model, r.ID(), r.Strand)
+	return SequenceRecord{Name: name, Region: r, Sequence: string(seq)}, nil
+}
+
+func writeFASTA(w io.Writer, rec SequenceRecord) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, ">%s\n", rec.Name)
+	for i := 0; i < len(rec.Sequence); i += fastaLineWidth {
+		end := i + fastaLineWidth
+		if end > len(rec.Sequence) {
+			end = len(rec.Sequence)
+		}
+		fmt.Fprintln(out, rec.Sequence[i:end])
+	}
+	return out.Flush()
+}
+
+/** HTTP Routes **/
+
+// Picks JSON or FASTA for a sequence response, writing a 406 for anything else.
+func sequenceFormat(w http.ResponseWriter, r *http.Request, list bool) (string, bool) {
+	format := negotiateFormat(r)
+	if format != formatJSON && format != formatFASTA && !(list && format == formatNDJSON) {
+		writeProblem(w, http.StatusNotAcceptable, "not_acceptable", fmt.Sprintf("Sequences cannot be returned as %s.", format))
+		return "", false
+	}
+	return format, true
+}
+
+func writeSequence(w http.ResponseWriter, format string, rec SequenceRecord) {
+	var err error
+	if format == formatFASTA {
+		w.Header().Set("Content-Type", formatMediaTypes[formatFASTA])
+		err = writeFASTA(w, rec)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rec)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+func handleGetLocusSequence(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	id, ok := parseLocusID(w, v["id"])
+	if !ok {
+		return
+	}
+	format, ok := sequenceFormat(w, r, false)
+	if !ok {
+		return
+	}
+	locus, err := GetLocus(id)
+	if err != nil {
+		writeError(w, err, "Could not fetch Loci.")
+		return
+	}
+	genome, err := GetGenome()
+	if err != nil {
+		writeError(w, err, "Could not open the genome.")
+		return
+	}
+
+	rec, err := genome.LocusSequence(locus)
+	if err != nil {
+		writeError(w, err, "Could not read the sequence of the Locus.")
+		return
+	}
+	writeSequence(w, format, rec)
+}
+
+func handleGetMotifInstanceSequence(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+	start, err := strconv.ParseInt(v["start"], 10, 32)
+	if err != nil {
+		writeBadRequest(w, "Start field is invalid. Must be an integer.")
+		return
+	}
+	format, ok := sequenceFormat(w, r, false)
+	if !ok {
+		return
+	}
+
+	inst, err := GetMotifInstance(cell.Type, normalizeChrName(v["chr"]), int(start))
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Instances.")
+		return
+	}
+	model, err := inst.GetModel()
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Models.")
+		return
+	}
+	inst.Length = model.Length
+	genome, err := GetGenome()
+	if err != nil {
+		writeError(w, err, "Could not open the genome.")
+		return
+	}
+
+	rec, err := genome.MotifInstanceSequence(inst)
+	if err != nil {
+		writeError(w, err, "Could not read the sequence of the Motif Instance.")
+		return
+	}
+	writeSequence(w, format, rec)
+}
+
+// Lists the sequences of the Motif Instances of a cell type, filtered like the instances themselves.
+func handleGetMotifInstanceSequences(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	cell, err := GetCellType(v["type"])
+	if err != nil {
+		writeError(w, err, "Unable to fetch Cell Type.")
+		return
+	}
+	p, err := ParseListParams(r, motifInstanceList)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid_parameter", "Invalid list parameters: "+err.Error())
+		return
+	}
+	format, ok := sequenceFormat(w, r, true)
+	if !ok {
+		return
+	}
+	genome, err := GetGenome()
+	if err != nil {
+		writeError(w, err, "Could not open the genome.")
+		return
+	}
+
+	base := motifInstanceWithLengthQuery + " WHERE MI.CellType=?"
+	if format != formatJSON {
+		encoder := json.NewEncoder(w)
+		streamList(w, motifInstanceList, p, "Motif Instance sequences", formatMediaTypes[format], "", func(m MotifInstance) error {
+			rec, err := genome.MotifInstanceSequence(m)
+			if err != nil {
+				return err
+			}
+			if format == formatNDJSON {
+				return encoder.Encode(&rec)
+			}
+			return writeFASTA(w, rec)
+		}, base, cell.Type)
+		return
+	}
+
+	instances, total, err := queryList[MotifInstance](motifInstanceList, p, base, cell.Type)
+	if err != nil {
+		writeError(w, err, "Could not fetch Motif Instances.")
+		return
+	}
+	records := make([]SequenceRecord, len(instances))
+	for i, m := range instances {
+		records[i], err = genome.MotifInstanceSequence(m)
+		if err != nil {
+			writeError(w, err, "Could not read the sequences of the Motif Instances.")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(records)
+}
+
+func init() {
+	registerRoute(Route{path: "/loci/{id}/sequence", handler: handleGetLocusSequence, method: "GET",
+		summary: "Get the sequence of a locus, as JSON or FASTA", response: SequenceRecord{}, query: []string{"format"}})
+	registerRoute(Route{path: "/celltypes/{type}/motifs/sequences", handler: handleGetMotifInstanceSequences, method: "GET",
+		summary:  "List the sequences of the motif instances of a cell type, as JSON or FASTA",
+		response: []SequenceRecord{}, list: &motifInstanceList})
+	registerRoute(Route{path: "/celltypes/{type}/motifs/{chr}/{start}/sequence", handler: handleGetMotifInstanceSequence, method: "GET",
+		summary: "Get the sequence of a motif instance, reverse-complemented on the - strand, as JSON or FASTA", response: SequenceRecord{}, query: []string{"format"}})
+}
@@ -1,20 +1,32 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+/*
+A Route is an endpoint of the API. Everything past the method only describes
+the route for the OpenAPI document, see OpenAPI.go.
+*/
 type Route struct {
 	path    string
 	handler func(w http.ResponseWriter, r *http.Request)
 	method  string
+	summary string
+	// Values of the types of the request body and successful response, or nil if there is none.
+	body     interface{}
+	response interface{}
+	// The list parameters accepted, for routes responding with a list.
+	list *ListSpec
+	// Other query parameters read by the handler.
+	query []string
 }
 
 var routes = make([]Route, 0)
@@ -23,6 +35,18 @@ func registerRoute(r Route) {
 	routes = append(routes, r)
 }
 
+// A Command is a one-off job run instead of the server when its environment variable is set.
+type Command struct {
+	env string
+	run func()
+}
+
+var commands = make([]Command, 0)
+
+func registerCommand(c Command) {
+	commands = append(commands, c)
+}
+
 var db *sqlx.DB
 
 func main() {
@@ -33,12 +57,28 @@ func main() {
 		fmt.Println("[Warn] Using test db file. It's recommended to specify database file path using SQLITE_DB_PATH environment variable.")
 	}
 
+	// SQLite leaves foreign keys unchecked unless asked, per connection.
+	if strings.Contains(dbPath, "?") {
+		dbPath += "&_foreign_keys=on"
+	} else {
+		dbPath += "?_foreign_keys=on"
+	}
 	db = sqlx.MustConnect("sqlite3", dbPath)
 
-	_, loaderSet := os.LookupEnv("RUN_DB_LOADER")
-	if loaderSet {
-		RunDataLoader()
-	} else {
+	err := loadActiveAssembly()
+	if err != nil {
+		fmt.Println("[Warn] Could not load genome assembly, chromosomes will not be checked.", err.Error())
+	}
+
+	ranCommand := false
+	for _, c := range commands {
+		if _, set := os.LookupEnv(c.env); set {
+			c.run()
+			ranCommand = true
+		}
+	}
+
+	if !ranCommand {
 		mainRouter := mux.NewRouter()
 		r := mainRouter.PathPrefix("/api").Subrouter()
 
@@ -51,21 +91,3 @@ func main() {
 		http.ListenAndServe(":8080", mainRouter)
 	}
 }
-
-// Uses a generic GetAll function for the structs, to create a generic Route Handler.
-func handleGetGeneric[T any](getFunc func() ([]T, error)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		stuff, err := getFunc()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Could not load items.")
-		} else {
-			err := json.NewEncoder(w).Encode(&stuff)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Println(err.Error())
-				fmt.Fprint(w, "Could not load items.")
-			}
-		}
-	}
-}
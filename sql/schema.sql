@@ -6,35 +6,81 @@ CREATE TABLE CellTypes (
     Type varchar(255) primary key NOT NULL
 );
 
+/**
+Assemblies
+Name - "mm10"
+**/
+CREATE TABLE Assemblies (
+    Name varchar(255) primary key NOT NULL
+);
+
+/**
+Chromosomes, loaded from a chrom.sizes file.
+Assembly - "mm10"
+Name - "chrX"
+Length - 171031299
+**/
+CREATE TABLE Chromosomes (
+    Assembly varchar(255) NOT NULL,
+    Name varchar(255) NOT NULL,
+    Length INT NOT NULL,
+    PRIMARY KEY (Assembly, Name),
+    FOREIGN KEY (Assembly) REFERENCES Assemblies(Name),
+    CHECK (Length > 0)
+);
+
+/**
+Chromosome Aliases, mapping other names of a chromosome to its name in the assembly.
+Assembly - "mm10"
+Alias - "NC_000086.7"
+Chromosome - "chrX"
+**/
+CREATE TABLE ChromosomeAliases (
+    Assembly varchar(255) NOT NULL,
+    Alias varchar(255) NOT NULL,
+    Chromosome varchar(255) NOT NULL,
+    PRIMARY KEY (Assembly, Alias),
+    FOREIGN KEY (Assembly, Chromosome) REFERENCES Chromosomes(Assembly, Name)
+);
+
 /**
 Genes
 Name - "Plp1"
-Chr - "X"
+Chr - "chrX" (normalized against the active assembly)
 Start - 1.37E8
 Stop  - 1.37E8
+Strand - "+" or "-". Transcription starts at Start on "+", and at End on "-".
+Bin - UCSC interval bin of Start-End, maintained by the backend.
 **/
 CREATE TABLE Genes (
     Name varchar(255) primary key,
-    Chr varchar(3) NOT NULL,
+    Chr varchar(255) NOT NULL,
     Start int NOT NULL,
     End int NOT NULL,
-    Check (Start < End)
+    Strand char(1) NOT NULL DEFAULT '+',
+    Bin int NOT NULL DEFAULT 0,
+    Check (Start < End),
+    Check (Strand IN ('+', '-'))
 );
+CREATE INDEX GenesBinIndex ON Genes (Chr, Bin);
 
 /**
 Loci
 ID: "chrX:305000000-3100000000"
-Chr: "X"
+Chr: "chrX"
 Start: 305000000
 End:   310000000
+Bin:   UCSC interval bin of Start-End, maintained by the backend.
 **/
 CREATE TABLE Loci (
     ID varchar(255) primary key,
-    Chr varchar(3) NOT NULL,
+    Chr varchar(255) NOT NULL,
     Start INT NOT NULL,
     End INT NOT NULL,
+    Bin INT NOT NULL DEFAULT 0,
     CHECK (Start < End)
 );
+CREATE INDEX LociBinIndex ON Loci (Chr, Bin);
 
 /**
 Motif Models
@@ -57,41 +103,75 @@ CREATE TABLE MotifModels (
     CHECK (Length > 0)
 );
 
+/**
+Motif Matrices, one row per position of a matrix of a Motif Model.
+Model - "BHE40_MOUSE.H11MO.0A"
+Kind - "pcm" (counts), "pfm" (frequencies) or "pwm" (log-odds weights)
+Position - 0, counted from the 5' end of the motif, below the model Length.
+A, C, G, T - 12, 0, 3, 5
+**/
+CREATE TABLE MotifMatrices (
+    Model varchar(255) NOT NULL,
+    Kind varchar(3) NOT NULL,
+    Position INT NOT NULL,
+    A FLOAT NOT NULL,
+    C FLOAT NOT NULL,
+    G FLOAT NOT NULL,
+    T FLOAT NOT NULL,
+    PRIMARY KEY (Model, Kind, Position),
+    FOREIGN KEY (Model) REFERENCES MotifModels(Name),
+    CHECK (Kind IN ('pcm', 'pfm', 'pwm')),
+    CHECK (Position >= 0)
+);
+
 /**
 Motif Instance
 Cell Type - "PGN"
-Chr - "X"
+Chr - "chrX"
 Start - 250000
 Forward - True
 Threshold Score - 11.0796049119
 Locus ID - "ChrX:3500000-35050000"
 Model - "PBX1_MOUSE.H11MO.2.C"
+Bin - UCSC interval bin of Start to Start + model Length, maintained by the backend.
 **/
 CREATE TABLE MotifInstances (
     CellType varchar(255) NOT NULL,
-    Chr varchar(3) NOT NULL,
+    Chr varchar(255) NOT NULL,
     Start INT NOT NULL,
     Forward BOOLEAN NOT NULL,
     ThresholdScore FLOAT NOT NULL,
     LocusID varchar(255) NOT NULL,
     Model varchar(255) NOT NULL,
+    Bin INT NOT NULL DEFAULT 0,
     PRIMARY KEY (CellType, Chr, Start),
     FOREIGN KEY (CellType) REFERENCES CellTypes(Type),
     FOREIGN KEY (LocusID) REFERENCES Loci(ID),
     FOREIGN KEY (Model) REFERENCES MotifModels(Name)
 );
+CREATE INDEX MotifInstancesBinIndex ON MotifInstances (Chr, Bin);
 
 /**
 Interactions
 Cell Type - "PGN"
-ID - Unique ID (Sqllite recommends just leaving as int PRIMARY KEY)
+ID - Unique ID (Must be INTEGER PRIMARY KEY, so it is the rowid)
 It'll auto fill UID if not defined.
+Signature - "chrX:0-2000,chrX:4000-6000", the sorted IDs of the anchors, maintained by the backend. NULL without anchors.
+SupportCount - 2, the number of times the interaction was created.
+ContactCount - 12, PValue - 0.0001, QValue - 0.005, Caller - "HiCCUPS", given by the loop caller. NULL when not known.
 **/
 CREATE TABLE Interactions (
     CellType varchar(255) NOT NULL,
-    ID int PRIMARY KEY,
+    ID INTEGER PRIMARY KEY,
+    Signature text,
+    SupportCount int NOT NULL DEFAULT 1,
+    ContactCount int,
+    PValue real,
+    QValue real,
+    Caller varchar(255),
     FOREIGN KEY (CellType) REFERENCES CellTypes(Type)
 );
+CREATE UNIQUE INDEX InteractionsSignatureIndex ON Interactions (CellType, Signature);
 
 /**
 Gene expression
@@ -115,11 +195,13 @@ Interaction ID - 1234
 **/
 CREATE TABLE InteractionParticipation (
     Locus varchar(255),
-    Interaction varchar(255),
+    Interaction INTEGER NOT NULL,
     FOREIGN KEY (Locus) REFERENCES Loci(ID),
     FOREIGN KEY (Interaction) REFERENCES Interactions(ID),
-    PRIMARY KEY (Locus, Interaction)
+    PRIMARY KEY (Locus, Interaction),
+    Check (typeof(Interaction) = 'integer')
 );
+CREATE INDEX InteractionParticipationInteractionIndex ON InteractionParticipation (Interaction);
 
 /**
 Gene Located in Locus